@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jparklab/synology-csi/cmd/syno-csi-plugin/options"
+	"github.com/jparklab/synology-csi/pkg/driver"
+)
+
+// newGCCommand creates the command to find and delete orphaned LUNs and targets
+func newGCCommand(runOptions *options.RunOptions) *cobra.Command {
+	gcOptions := options.NewGCOptions()
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete LUNs and targets which do not belong to any volume",
+		Long: "Find LUNs and targets created by the driver which do not belong to any live volume, " +
+			"and delete them. Nothing is deleted unless --dry-run=false is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flag.CommandLine.Parse([]string{"--logtostderr=1"})
+
+			synoOptions, err := options.ReadConfig(runOptions.SynologyConf)
+			if err != nil {
+				fmt.Printf("Failed to read config: %v\n", err)
+				return err
+			}
+
+			var volumeIDs []string
+			if gcOptions.VolumeIDsFile != "" {
+				volumeIDs, err = readVolumeIDs(gcOptions.VolumeIDsFile)
+			} else {
+				volumeIDs, err = driver.LiveVolumeIDsFromPersistentVolumes()
+			}
+			if err != nil {
+				fmt.Printf("Failed to get live volumes: %v\n", err)
+				return err
+			}
+
+			gc, err := driver.NewGarbageCollector(synoOptions, driver.GCOptions{
+				DryRun:           gcOptions.DryRun,
+				MinAge:           gcOptions.MinAge,
+				StateFile:        gcOptions.StateFile,
+				VolumeNamePrefix: gcOptions.VolumeNamePrefix,
+			})
+			if err != nil {
+				fmt.Printf("Failed to create garbage collector: %v\n", err)
+				return err
+			}
+
+			orphans, err := gc.Collect(volumeIDs)
+			printOrphans(orphans)
+			if err != nil {
+				fmt.Printf("Failed to collect garbage: %v\n", err)
+				return err
+			}
+
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	gcOptions.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+// readVolumeIDs reads volume IDs from the file, ignoring empty lines and comments
+func readVolumeIDs(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeIDs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		volumeIDs = append(volumeIDs, line)
+	}
+	return volumeIDs, nil
+}
+
+func printOrphans(orphans []driver.Orphan) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tKIND\tNAME\tID\tAGE\tSTATUS")
+	for _, orphan := range orphans {
+		status := "deleted"
+		if !orphan.Deleted {
+			status = "kept: " + orphan.Skipped
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			orphan.Backend, orphan.Kind, orphan.Name, orphan.ID, orphan.Age.Round(time.Second), status)
+	}
+	w.Flush()
+}
@@ -40,25 +40,50 @@ func main() {
 			endpoint := runOptions.Endpoint
 			nodeID := runOptions.NodeID
 
-			synoOption, err := options.ReadConfig(runOptions.SynologyConf)
+			synoOptions, err := options.ReadConfig(runOptions.SynologyConf)
 			if err != nil {
 				fmt.Printf("Failed to read config: %v\n", err)
 				return err
 			}
 
 			if runOptions.CheckLogin {
-				_, _, err := driver.Login(synoOption)
+				for _, synoOption := range synoOptions {
+					_, _, err := driver.Login(synoOption)
+					if err != nil {
+						fmt.Printf("Failed to login to %s: %v\n", synoOption.Host, err)
+						return err
+					}
+				}
+				return nil
+			}
+
+			nodeTopology := map[string]string{}
+			if len(runOptions.NodeTopologyLabels) > 0 {
+				nodeTopology, err = driver.NodeTopologyFromLabels(nodeID, runOptions.NodeTopologyLabels)
 				if err != nil {
-					fmt.Printf("Failed to login: %v\n", err)
+					fmt.Printf("Failed to get topology from node labels: %v\n", err)
+					return err
 				}
-				return err
+			}
+			for key, value := range runOptions.NodeTopology {
+				nodeTopology[key] = value
 			}
 
-			drv, err := driver.NewDriver(nodeID, endpoint, synoOption)
+			drv, err := driver.NewDriver(nodeID, endpoint, nodeTopology, runOptions.InitiatorNameFile, synoOptions)
 			if err != nil {
 				fmt.Printf("Failed to create driver: %v\n", err)
 				return err
 			}
+
+			if runOptions.GCInterval > 0 {
+				gc := drv.GarbageCollector(driver.GCOptions{
+					DryRun:           runOptions.GCDryRun,
+					MinAge:           runOptions.GCMinAge,
+					VolumeNamePrefix: runOptions.GCVolumeNamePrefix,
+				})
+				go gc.Run(runOptions.GCInterval, driver.LiveVolumeIDsFromPersistentVolumes, nil)
+			}
+
 			drv.Run()
 
 			return nil
@@ -67,6 +92,7 @@ func main() {
 	}
 
 	runOptions.AddFlags(rootCmd, rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newGCCommand(runOptions))
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
 	if err := rootCmd.Execute(); err != nil {
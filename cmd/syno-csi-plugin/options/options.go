@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -30,6 +31,7 @@ import (
 	"github.com/spf13/pflag"
 
 	"github.com/jparklab/synology-csi/pkg/driver"
+	"github.com/jparklab/synology-csi/pkg/synology/core"
 	"github.com/jparklab/synology-csi/pkg/synology/options"
 )
 
@@ -39,31 +41,129 @@ type RunOptions struct {
 	Endpoint     string
 	SynologyConf string
 	CheckLogin   bool // Check if app is able to log into Synology and exit immediately
+
+	NodeTopology       map[string]string // Topology segments of the node
+	NodeTopologyLabels []string          // Labels of the node to use as topology segments
+	InitiatorNameFile  string            // File containing the iscsi initiator name of the node
+
+	GCInterval time.Duration // Interval of deleting orphaned LUNs and targets, 0 to disable
+	GCDryRun   bool          // Report orphaned LUNs and targets without deleting them
+	GCMinAge   time.Duration // Delete orphans only after they have been found for the duration
+	// Collect only orphans of volumes whose names start with the prefix
+	GCVolumeNamePrefix string
 }
 
+// GCOptions stores option values of the gc command
+type GCOptions struct {
+	DryRun        bool
+	MinAge        time.Duration
+	StateFile     string // File to keep the time orphans were found across runs
+	VolumeIDsFile string // File containing IDs of live volumes, one per line
+	// Collect only orphans of volumes whose names start with the prefix
+	VolumeNamePrefix string
+}
+
+const (
+	// defaultVolumeNamePrefix is the default prefix external-provisioner gives to the names of volumes
+	defaultVolumeNamePrefix = "pvc"
+	// defaultRequestTimeout is the timeout of requests to the NAS if it is not configured
+	defaultRequestTimeout = 60 * time.Second
+)
+
 // NewRunOptions creates a default option object
 func NewRunOptions() *RunOptions {
 	return &RunOptions{
 		NodeID:   "CSINode",
 		Endpoint: "unix:///var/lib/kubelet/plugins/" + driver.DriverName + "/csi.sock",
+
+		InitiatorNameFile: "/etc/iscsi/initiatorname.iscsi",
+
+		GCDryRun:           true,
+		GCMinAge:           time.Hour,
+		GCVolumeNamePrefix: defaultVolumeNamePrefix,
+	}
+}
+
+// NewGCOptions creates a default option object of the gc command
+func NewGCOptions() *GCOptions {
+	return &GCOptions{
+		DryRun:           true,
+		MinAge:           time.Hour,
+		VolumeNamePrefix: defaultVolumeNamePrefix,
 	}
 }
 
+// synologyConfig is the content of the configuration file
+//
+// The file either contains options of a single NAS at the top level,
+// or a list of named backends
+type synologyConfig struct {
+	options.SynologyOptions `yaml:",inline"`
+
+	Backends []yaml.MapSlice `yaml:"backends"`
+}
+
 // ReadConfig reads synology configuration file
-func ReadConfig(path string) (*options.SynologyOptions, error) {
+func ReadConfig(path string) ([]*options.SynologyOptions, error) {
 	f, err := ioutil.ReadFile(path)
 	if err != nil {
 		glog.V(1).Infof("Unable to open config file: %v", err)
 		return nil, err
 	}
 
-	conf := options.NewSynologyOptions()
-	err = yaml.Unmarshal(f, &conf)
+	config := synologyConfig{SynologyOptions: options.NewSynologyOptions()}
+	err = yaml.Unmarshal(f, &config)
 	if err != nil {
 		glog.V(1).Infof("Failed to parse config: %v", err)
 		return nil, err
 	}
 
+	if len(config.Backends) == 0 {
+		conf, err := normalizeConfig(config.SynologyOptions)
+		if err != nil {
+			return nil, err
+		}
+		return []*options.SynologyOptions{conf}, nil
+	}
+
+	var confs []*options.SynologyOptions
+	names := map[string]bool{}
+	for _, backend := range config.Backends {
+		// re-encode each backend to fill default values
+		encoded, err := yaml.Marshal(backend)
+		if err != nil {
+			return nil, err
+		}
+
+		backendConf := options.NewSynologyOptions()
+		if err = yaml.Unmarshal(encoded, &backendConf); err != nil {
+			glog.V(1).Infof("Failed to parse backend config: %v", err)
+			return nil, err
+		}
+
+		if backendConf.Name == "" {
+			return nil, fmt.Errorf("Name is required for backend %s", backendConf.Host)
+		}
+		if strings.Contains(backendConf.Name, ":") {
+			return nil, fmt.Errorf("Invalid backend name %s: must not contain ':'", backendConf.Name)
+		}
+		if names[backendConf.Name] {
+			return nil, fmt.Errorf("Duplicated backend name: %s", backendConf.Name)
+		}
+		names[backendConf.Name] = true
+
+		conf, err := normalizeConfig(backendConf)
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, conf)
+	}
+
+	return confs, nil
+}
+
+// normalizeConfig validates options of a NAS, and fills default values
+func normalizeConfig(conf options.SynologyOptions) (*options.SynologyOptions, error) {
 	if conf.LoginApiVersion <= 0 {
 		conf.LoginApiVersion = 2
 	}
@@ -84,7 +184,7 @@ func ReadConfig(path string) (*options.SynologyOptions, error) {
 			deviceId := os.Getenv("DEVICE_ID")
 			conf.DeviceId = &deviceId
 			if deviceId != "" {
-				glog.V(1).Info("Using DEVICE_ID from environment variables: %v", deviceId)
+				glog.V(1).Infof("Using DEVICE_ID from environment variables: %v", deviceId)
 			}
 		}
 		if conf.EnableDeviceToken != nil {
@@ -99,6 +199,20 @@ func ReadConfig(path string) (*options.SynologyOptions, error) {
 		}
 	}
 
+	conf.Format = strings.TrimSpace(strings.ToLower(conf.Format))
+	if conf.Format == "" {
+		conf.Format = core.FormatSid
+	}
+	if conf.Format != core.FormatSid && conf.Format != core.FormatCookie {
+		glog.V(1).Infof("Invalid format in config: %v", conf.Format)
+		return nil, fmt.Errorf("Invalid format in config: %v", conf.Format)
+	}
+
+	// requests to a NAS which does not respond must not block the driver forever
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultRequestTimeout
+	}
+
 	conf.LoginHttpMethod = strings.TrimSpace(strings.ToUpper(conf.LoginHttpMethod))
 	if conf.LoginHttpMethod == "AUTO" {
 		if conf.LoginApiVersion >= 6 {
@@ -124,6 +238,37 @@ func (o *RunOptions) AddFlags(cmd *cobra.Command, fs *pflag.FlagSet) {
 	fs.StringVar(&o.SynologyConf, "synology-config", o.SynologyConf, "Synology config yaml file")
 	fs.BoolVar(&o.CheckLogin, "check-login", o.CheckLogin, "Just try to login and exit")
 
+	fs.StringToStringVar(&o.NodeTopology, "node-topology", o.NodeTopology,
+		"Topology segments of the node, e.g. topology.csi.synology.com/network=storage")
+	fs.StringSliceVar(&o.NodeTopologyLabels, "node-topology-labels", o.NodeTopologyLabels,
+		"Labels of the kubernetes node to use as topology segments, e.g. topology.kubernetes.io/zone")
+	fs.StringVar(&o.InitiatorNameFile, "initiator-name-file", o.InitiatorNameFile,
+		"File containing the iscsi initiator name of the node")
+
+	fs.DurationVar(&o.GCInterval, "gc-interval", o.GCInterval,
+		"Interval of deleting orphaned LUNs and targets, which do not belong to any PersistentVolume. 0 to disable")
+	fs.BoolVar(&o.GCDryRun, "gc-dry-run", o.GCDryRun, "Report orphaned LUNs and targets without deleting them")
+	fs.DurationVar(&o.GCMinAge, "gc-min-age", o.GCMinAge,
+		"Delete orphaned LUNs and targets after they have been found for the duration")
+	fs.StringVar(&o.GCVolumeNamePrefix, "gc-volume-name-prefix", o.GCVolumeNamePrefix,
+		"Delete only orphaned LUNs and targets of volumes whose names start with the prefix, "+
+			"which is --volume-name-prefix of csi-provisioner")
+
 	cmd.MarkFlagRequired("endpoint")
 	cmd.MarkFlagRequired("synology-config")
 }
+
+// AddFlags adds command line options of the gc command
+func (o *GCOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "Report orphaned LUNs and targets without deleting them")
+	fs.DurationVar(&o.MinAge, "min-age", o.MinAge,
+		"Delete orphaned LUNs and targets after they have been found for the duration, "+
+			"which is kept across runs in --state-file")
+	fs.StringVar(&o.StateFile, "state-file", o.StateFile,
+		"File to keep the time orphaned LUNs and targets were found across runs")
+	fs.StringVar(&o.VolumeIDsFile, "volume-ids-file", o.VolumeIDsFile,
+		"File containing IDs of live volumes, one per line. PersistentVolumes of the cluster are used if not given")
+	fs.StringVar(&o.VolumeNamePrefix, "volume-name-prefix", o.VolumeNamePrefix,
+		"Collect only orphaned LUNs and targets of volumes whose names start with the prefix, "+
+			"which is --volume-name-prefix of csi-provisioner")
+}
@@ -9,8 +9,9 @@ replace k8s.io/apimachinery => k8s.io/apimachinery v0.18.2-beta.0
 require (
 	github.com/avast/retry-go v2.5.0+incompatible
 	github.com/checkpoint-restore/go-criu v0.0.0-20190109184317-bdb7599cd87b // indirect
-	github.com/container-storage-interface/spec v1.2.0
+	github.com/container-storage-interface/spec v1.3.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/golang/protobuf v1.3.2
 	github.com/google/go-querystring v1.0.0
 	github.com/kubernetes-csi/drivers v1.0.0
 	github.com/opencontainers/runc v1.0.0-rc9 // indirect
@@ -22,8 +23,11 @@ require (
 	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
 	google.golang.org/grpc v1.26.0
 	gopkg.in/yaml.v2 v2.2.8
+	k8s.io/api v0.18.1 // indirect
+	k8s.io/apimachinery v0.18.1
+	k8s.io/client-go v0.18.1
 	k8s.io/klog v1.0.0
-	k8s.io/kubernetes v1.18.0 // indirect
+	k8s.io/kubernetes v1.18.0
 	k8s.io/utils v0.0.0-20200324210504-a9aa75ae1b89
 )
 
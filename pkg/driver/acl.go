@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+)
+
+var (
+	errPublishedToOtherNode = errors.New("Volume is published to another node")
+	errIncompatiblePublish  = errors.New("Volume is published to the node with a different permission")
+)
+
+// isInitiatorName returns true if the node ID is an initiator name reported by NodeGetInfo,
+// nodes registered by older versions of the driver use the node name instead
+func isInitiatorName(nodeID string) bool {
+	return strings.HasPrefix(nodeID, "iqn.") || strings.HasPrefix(nodeID, "eui.")
+}
+
+// grantInitiator returns ACLs of the target with the permission of the initiator added.
+// Other initiators must not have access to the target if singleNode is true.
+// The returned bool is false if the ACLs already have the permission.
+func grantInitiator(
+	acls []iscsi.TargetACL, iqn string, permission string, singleNode bool,
+) ([]iscsi.TargetACL, bool, error) {
+	granted := false
+	hasDefault := false
+	changed := false
+
+	var newACLs []iscsi.TargetACL
+	for _, acl := range acls {
+		switch {
+		case acl.IQN == iscsi.TargetDefaultACLIQN:
+			hasDefault = true
+			if acl.Permission != iscsi.TargetPermissionNoAccess {
+				acl.Permission = iscsi.TargetPermissionNoAccess
+				changed = true
+			}
+		case acl.IQN == iqn:
+			if acl.Permission != permission {
+				return nil, false, errIncompatiblePublish
+			}
+			granted = true
+		case acl.Permission != iscsi.TargetPermissionNoAccess && singleNode:
+			return nil, false, errPublishedToOtherNode
+		}
+		newACLs = append(newACLs, acl)
+	}
+
+	if !granted {
+		newACLs = append(newACLs, iscsi.TargetACL{IQN: iqn, Permission: permission})
+		changed = true
+	}
+	if !hasDefault {
+		newACLs = append(newACLs, iscsi.TargetACL{
+			IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionNoAccess,
+		})
+		changed = true
+	}
+
+	return newACLs, changed, nil
+}
+
+// grantedInitiators returns initiators allowed to access the target
+func grantedInitiators(acls []iscsi.TargetACL) []string {
+	var initiators []string
+	for _, acl := range acls {
+		if acl.IQN != iscsi.TargetDefaultACLIQN && acl.Permission != iscsi.TargetPermissionNoAccess {
+			initiators = append(initiators, acl.IQN)
+		}
+	}
+	return initiators
+}
+
+// revokeInitiator returns ACLs of the target without the initiator.
+// The returned bool is false if the initiator is not in the ACLs.
+func revokeInitiator(acls []iscsi.TargetACL, iqn string) ([]iscsi.TargetACL, bool) {
+	changed := false
+
+	var newACLs []iscsi.TargetACL
+	for _, acl := range acls {
+		if acl.IQN == iqn {
+			changed = true
+			continue
+		}
+		newACLs = append(newACLs, acl)
+	}
+
+	return newACLs, changed
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestGrantInitiator(t *testing.T) {
+	node1 := "iqn.1993-08.org.debian:01:node1"
+	node2 := "iqn.1993-08.org.debian:01:node2"
+	defaultRW := iscsi.TargetACL{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionReadWrite}
+	defaultNo := iscsi.TargetACL{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionNoAccess}
+	node1RW := iscsi.TargetACL{IQN: node1, Permission: iscsi.TargetPermissionReadWrite}
+	node2RO := iscsi.TargetACL{IQN: node2, Permission: iscsi.TargetPermissionReadOnly}
+
+	// a target open to all initiators is restricted to the node
+	acls, changed, err := grantInitiator([]iscsi.TargetACL{defaultRW}, node1, iscsi.TargetPermissionReadWrite, true)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{defaultNo, node1RW}, acls)
+
+	// publishing again does not change ACLs
+	acls, changed, err = grantInitiator(acls, node1, iscsi.TargetPermissionReadWrite, true)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{defaultNo, node1RW}, acls)
+
+	// a default ACL is added when missing
+	acls, changed, err = grantInitiator(nil, node1, iscsi.TargetPermissionReadWrite, true)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{node1RW, defaultNo}, acls)
+
+	// single node volumes can not be published to another node
+	_, _, err = grantInitiator([]iscsi.TargetACL{defaultNo, node1RW}, node2, iscsi.TargetPermissionReadWrite, true)
+	assert.Equal(t, errPublishedToOtherNode, err)
+
+	_, _, err = grantInitiator([]iscsi.TargetACL{defaultNo, node1RW}, node1, iscsi.TargetPermissionReadOnly, true)
+	assert.Equal(t, errIncompatiblePublish, err)
+
+	// multi node volumes can be published to other nodes
+	acls, changed, err = grantInitiator([]iscsi.TargetACL{defaultNo, node1RW}, node2, iscsi.TargetPermissionReadOnly, false)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{defaultNo, node1RW, node2RO}, acls)
+}
+
+func TestRevokeInitiator(t *testing.T) {
+	node1 := "iqn.1993-08.org.debian:01:node1"
+	defaultNo := iscsi.TargetACL{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionNoAccess}
+	node1RW := iscsi.TargetACL{IQN: node1, Permission: iscsi.TargetPermissionReadWrite}
+
+	acls, changed := revokeInitiator([]iscsi.TargetACL{defaultNo, node1RW}, node1)
+	assert.True(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{defaultNo}, acls)
+
+	acls, changed = revokeInitiator(acls, node1)
+	assert.False(t, changed)
+	assert.Equal(t, []iscsi.TargetACL{defaultNo}, acls)
+}
+
+func TestIsInitiatorName(t *testing.T) {
+	assert.True(t, isInitiatorName("iqn.1993-08.org.debian:01:node1"))
+	assert.True(t, isInitiatorName("eui.02004567A425678D"))
+	assert.False(t, isInitiatorName("node1"))
+	assert.False(t, isInitiatorName(""))
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+	"github.com/jparklab/synology-csi/pkg/synology/options"
+)
+
+// backend provides APIs of a Synology NAS
+type backend struct {
+	// name of the backend, empty when the driver uses a single NAS
+	name string
+	// host of the NAS
+	host string
+	// topology segments of nodes which can access the NAS
+	topology map[string]string
+
+	targetAPI   iscsi.TargetAPI
+	lunAPI      iscsi.LunAPI
+	snapshotAPI iscsi.SnapshotAPI
+	volumeAPI   storage.VolumeAPI
+
+	iscsiDrv iscsiDriver
+}
+
+func newBackend(synoOption *options.SynologyOptions, session core.Session) *backend {
+	portals := synoOption.Portals
+	if len(portals) == 0 {
+		portals = []string{synoOption.Host}
+	}
+
+	return &backend{
+		name:        synoOption.Name,
+		host:        synoOption.Host,
+		topology:    synoOption.Topology,
+		targetAPI:   iscsi.NewTargetAPI(session),
+		lunAPI:      iscsi.NewLunAPI(session),
+		snapshotAPI: iscsi.NewSnapshotAPI(session),
+		volumeAPI:   storage.NewVolumeAPI(session),
+		iscsiDrv:    iscsiDriver{portals: portals},
+	}
+}
+
+// backendList is the list of backends, the first one is the default backend
+type backendList []*backend
+
+// get returns the backend of the name, or the default backend if name is empty
+func (l backendList) get(name string) (*backend, error) {
+	if len(l) == 0 {
+		return nil, fmt.Errorf("No backend is configured")
+	}
+
+	if name == "" {
+		return l[0], nil
+	}
+
+	for _, b := range l {
+		if b.name == name {
+			return b, nil
+		}
+	}
+
+	var names []string
+	for _, b := range l {
+		names = append(names, b.name)
+	}
+
+	return nil, fmt.Errorf("Unable to find backend %s, valid backends: %v", name, names)
+}
+
+// findTarget returns the backend and the target of the volume ID.
+// It fails with NotFound unless the target still maps the LUN the volume was created with.
+func (l backendList) findTarget(id string) (*backend, *iscsi.Target, *volumeID, error) {
+	volID, err := parseVolumeID(id)
+	if err != nil {
+		return nil, nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	b, err := l.get(volID.backendName)
+	if err != nil {
+		glog.V(3).Info(err.Error())
+		return nil, nil, nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	target, err := b.targetAPI.Get(volID.targetID)
+	if isNotFound(err) {
+		msg := fmt.Sprintf("Unable to find target of ID(%d): %v", volID.targetID, err)
+		glog.V(3).Info(msg)
+		return nil, nil, nil, status.Error(codes.NotFound, msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to get target of ID(%d): %v", volID.targetID, err)
+		glog.V(3).Info(msg)
+		return nil, nil, nil, apiErrorStatus(err, msg)
+	}
+
+	if volID.mappingIndex < 1 || len(target.MappedLuns) < volID.mappingIndex {
+		msg := fmt.Sprintf("Target %s(%d) does not have mapping for index %d",
+			target.Name, target.TargetID, volID.mappingIndex)
+		glog.V(3).Info(msg)
+		return nil, nil, nil, status.Error(codes.NotFound, msg)
+	}
+
+	mapping := target.MappedLuns[volID.mappingIndex-1]
+	if volID.lunUUID == "" {
+		// legacy volume IDs do not have the LUN UUID
+		volID.lunUUID = mapping.LunUUID
+	} else if mapping.LunUUID != volID.lunUUID {
+		msg := fmt.Sprintf(
+			"Target %s(%d) maps LUN %s instead of %s at index %d, the target might have been recreated",
+			target.Name, target.TargetID, mapping.LunUUID, volID.lunUUID, volID.mappingIndex)
+		glog.V(3).Info(msg)
+		return nil, nil, nil, status.Error(codes.NotFound, msg)
+	}
+
+	return b, target, volID, nil
+}
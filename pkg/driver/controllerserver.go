@@ -20,13 +20,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/pborman/uuid"
+	"github.com/golang/protobuf/ptypes"
 	"golang.org/x/net/context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -37,50 +38,31 @@ import (
 )
 
 const (
-	defaultVolumeSize      = int64(1 * 1024 * 1024 * 1024)
-	defaultLocation        = "/volume1"
-	defaultVolumeTypeExt4  = iscsi.LunTypeThin
-	defaultVolumeTypeBtrfs = iscsi.LunTypeBlun
+	defaultVolumeSize = int64(1 * 1024 * 1024 * 1024)
+	defaultLocation   = "/volume1"
 
-	targetNamePrefix = "kube-csi"
-	lunNamePrefix    = "kube-csi"
+	targetNamePrefix   = "kube-csi"
+	lunNamePrefix      = "kube-csi"
+	snapshotNamePrefix = "kube-csi"
 
 	iqnPrefix = "iqn.2000-01.com.synology:kube-csi"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	targetAPI iscsi.TargetAPI
-	lunAPI    iscsi.LunAPI
-	volumeAPI storage.VolumeAPI
+	backends backendList
+
+	// serializes publishing and unpublishing a volume, which update the ACLs of the target
+	publishLocks keyMutex
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	volID := req.GetVolumeId()
 
-	targetID, mappingIndex, err := parseVolumeID(volID)
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
-	}
-
-	target, err := cs.targetAPI.Get(targetID)
-	if err != nil {
-		msg := fmt.Sprintf("Unable to find target of ID(%d): %v", targetID, err)
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.NotFound, msg)
-	}
-
-	if len(target.MappedLuns) < mappingIndex {
-		msg := fmt.Sprintf("Target %s(%d) does not have mapping for index %d", target.Name, target.TargetID, mappingIndex)
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.FailedPrecondition, msg)
-	}
-
 	// Get LUN
-	mapping := target.MappedLuns[mappingIndex-1]
-	lun, err := cs.lunAPI.Get(mapping.LunUUID)
+	b, _, lun, err := cs.findVolume(volID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
 	// Get request size and current size (GB)
@@ -99,23 +81,23 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}
 
 	// Check whether expanded size is allocatable or not in synology volume
-	vol, err := cs.volumeAPI.Get(lun.Location)
+	vol, err := b.volumeAPI.Get(lun.Location)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, apiErrorStatus(err, err.Error())
 	}
-	capacity, _ := strconv.ParseInt(vol.SizeFreeByte, 10, 64)
+	capacity := vol.SizeFreeByte
 	if capacity < (requestGb<<30 - currentGb<<30) {
-		msg := fmt.Sprintf("no enough space in synology volume: %s Byte left", capacity)
-		return nil, status.Error(codes.Internal, msg)
+		msg := fmt.Sprintf("no enough space in synology volume: %d Byte left", capacity)
+		return nil, status.Error(codes.ResourceExhausted, msg)
 	}
 
 	// Update LUN for expanding volume
-	err = cs.lunAPI.Update(lun.UUID, requestGb<<30)
+	err = b.lunAPI.Update(lun.UUID, requestGb<<30)
 	if err != nil {
 		msg := fmt.Sprintf(
-			"Unable to update volume: %s", lun.Name)
+			"Unable to update volume: %s: %v", lun.Name, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, apiErrorStatus(err, msg)
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
@@ -124,253 +106,521 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}, nil
 }
 
-// CreateVolume creates a LUN and a target for a volume
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+// CreateVolume creates a LUN and a target for a volume.
+//
+// It returns the existing volume if a volume of the name has been created with compatible parameters,
+// and repairs volumes left without a target or a LUN mapped to the target by a failed request.
+// The LUN and the target created by the request are removed if it fails.
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
 	// Volume name
 	volName := req.GetName()
 	if len(volName) == 0 {
-		volName = uuid.NewUUID().String()
+		return nil, status.Error(codes.InvalidArgument, "Volume name is required")
+	}
+
+	caps := req.GetVolumeCapabilities()
+	if len(caps) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities are required")
+	}
+
+	readOnly := true
+	for _, c := range caps {
+		if err := cs.validateVolumeCapability(c); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		readOnly = readOnly && isReadOnlyMode(c.GetAccessMode().GetMode())
+	}
+
+	if readOnly && req.GetVolumeContentSource() == nil {
+		// an empty volume has no file system, and can not be written to create one
+		return nil, status.Error(codes.InvalidArgument,
+			"Read-only volumes must be created from a snapshot or a volume")
 	}
 
 	// Volume size
-	volSizeByte := defaultVolumeSize
-	if req.GetCapacityRange() != nil {
-		volSizeByte = int64(req.GetCapacityRange().GetRequiredBytes())
+	capRange := req.GetCapacityRange()
+	requiredBytes := capRange.GetRequiredBytes()
+	limitBytes := capRange.GetLimitBytes()
+	if requiredBytes < 0 || limitBytes < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity must not be negative")
+	}
+	if limitBytes != 0 && requiredBytes > limitBytes {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"Required bytes %d exceeds the limit %d", requiredBytes, limitBytes)
+	}
+
+	volSizeByte := requiredBytes
+	if volSizeByte == 0 {
+		volSizeByte = defaultVolumeSize
+		if limitBytes != 0 && limitBytes < volSizeByte {
+			volSizeByte = limitBytes
+		}
 	}
 
 	//
 	// Create volumes
 	//
 	params := req.GetParameters()
+	b, err := cs.backends.selectBackend(params["backend"], req.GetAccessibilityRequirements())
+	if err == errNoAccessibleBackend {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	location, present := params["location"]
 	if !present {
 		location = defaultLocation
 	}
 
-	// check if location exists
-	volume, err := cs.volumeAPI.Get(location)
-	if err != nil {
-		volumes, listErr := cs.volumeAPI.List()
-		if listErr != nil {
-			return nil, status.Errorf(
-				codes.Internal,
-				fmt.Sprintf("Unable to list storage volumes: %v", listErr))
+	// DSM clones LUNs from a snapshot at the location of the LUN the snapshot is taken from
+	if srcSnapshot := req.GetVolumeContentSource().GetSnapshot(); srcSnapshot != nil {
+		snapshot, err := cs.getSourceSnapshot(b, srcSnapshot.GetSnapshotId())
+		if err != nil {
+			return nil, err
 		}
-
-		var locations []string
-		for _, vol := range volumes {
-			locations = append(locations, vol.VolumePath)
+		if snapshot.RootPath != "" {
+			if present && location != snapshot.RootPath {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"Volumes from snapshot %s must be at %s, not at %s",
+					srcSnapshot.GetSnapshotId(), snapshot.RootPath, location)
+			}
+			location = snapshot.RootPath
 		}
+	}
 
-		return nil, status.Errorf(
-			codes.InvalidArgument,
-			fmt.Sprintf("Unable to find location %s, valid locations: %v", location, locations))
+	// check if location exists
+	volume, err := getLocation(b, location)
+	if err != nil {
+		return nil, err
 	}
 
 	glog.V(5).Infof("Found the volume for the location %s: %v", location, volume)
 
-	volType, present := params["type"]
-	if !present {
-		if volume.FSType == storage.FSTypeExt4 {
-			volType = defaultVolumeTypeExt4
-		} else if volume.FSType == storage.FSTypeBtrfs {
-			volType = defaultVolumeTypeBtrfs
-		}
+	volType, err := selectLunType(volume.FSType, params["type"], params["provisioning"])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	lunName := fmt.Sprintf("%s-%s", lunNamePrefix, volName)
 	targetName := fmt.Sprintf("%s-%s", targetNamePrefix, volName)
 	targetIQN := fmt.Sprintf("%s-%s", iqnPrefix, volName)
 
+	wf := newProvisionWorkflow(volName)
+	defer func() {
+		if err != nil {
+			wf.rollback()
+		} else {
+			wf.commit()
+		}
+	}()
+
 	// check if lun already exists
-	lun, err := cs.lunAPI.Get(lunName)
+	lun, err := b.lunAPI.Get(lunName)
+	if err != nil && !isNotFound(err) {
+		msg := fmt.Sprintf("Failed to get LUN %s: %v", lunName, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
 	if lun == nil {
-		// create a lun
-		newLun, err := cs.lunAPI.Create(
-			lunName,
-			location,
-			volSizeByte,
-			volType,
-		)
+		var newLun *iscsi.Lun
+		if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+			// populate the lun from the snapshot or the volume
+			newLun, err = cs.cloneLun(
+				wf, b, lunName, location, capRange, contentSource)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// create a lun
+			newLun, err = b.lunAPI.Create(
+				lunName,
+				location,
+				volSizeByte,
+				volType,
+			)
 
-		if err != nil {
-			msg := fmt.Sprintf(
-				"Failed to create a LUN(name: %s, location: %s, size: %d, type: %s): %v",
-				lunName, location, volSizeByte, volType, err)
+			if err != nil {
+				msg := fmt.Sprintf(
+					"Failed to create a LUN(name: %s, location: %s, size: %d, type: %s): %v",
+					lunName, location, volSizeByte, volType, err)
+				glog.V(3).Info(msg)
+				return nil, apiErrorStatus(err, msg)
+			}
+
+			wf.done(fmt.Sprintf("created LUN %s(%s)", newLun.Name, newLun.UUID), func() error {
+				return b.lunAPI.Delete(newLun.UUID)
+			})
+		}
+
+		// record the source, which DSM does not keep, to compare it on retried requests
+		description := lunDescription(req.GetVolumeContentSource())
+		if err = b.lunAPI.SetDescription(newLun.UUID, description); err != nil {
+			msg := fmt.Sprintf("Failed to set the description of LUN %s(%s): %v", lunName, newLun.UUID, err)
 			glog.V(3).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, apiErrorStatus(err, msg)
 		}
+		newLun.Description = description
 
 		glog.V(5).Infof("LUN %s(%s) created", lunName, newLun.UUID)
 		lun = newLun
 	} else {
-		msg := fmt.Sprintf(
-			"Volume %s already exists, found LUN %s. Will use existing LUN", volName, lunName)
-		glog.V(3).Info(msg)
-	}
+		glog.V(3).Infof("Volume %s already exists, found LUN %s(%s)", volName, lunName, lun.UUID)
 
-	var target *iscsi.Target
-	if lun.IsMapped {
-		// find mapped target
-		targets, err := cs.targetAPI.List()
+		// the type is compared only if it is requested, as older versions created LUNs without one.
+		// Cloned LUNs have the type of the source
+		requestedType := ""
+		if req.GetVolumeContentSource() == nil && (params["type"] != "" || params["provisioning"] != "") {
+			requestedType = volType
+		}
+
+		err = checkExistingLun(lun, location, requiredBytes, limitBytes, requestedType,
+			lunDescription(req.GetVolumeContentSource()))
 		if err != nil {
-			msg := fmt.Sprintf("Failed get list of targets: %v", err)
+			msg := fmt.Sprintf("Volume %s already exists with different parameters: %v", volName, err)
 			glog.V(3).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, status.Error(codes.AlreadyExists, msg)
 		}
+	}
 
-		for _, tgt := range targets {
-			isMappedToLun := false
-			for _, mappedLun := range tgt.MappedLuns {
-				if mappedLun.LunUUID == lun.UUID {
-					isMappedToLun = true
-					break
-				}
-			}
+	target, err := cs.ensureTarget(wf, b, lun, targetName, targetIQN, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
 
-			if isMappedToLun {
-				target = &tgt
-				break
+	mappingIndex := 1
+	for i, mapping := range target.MappedLuns {
+		if mapping.LunUUID == lun.UUID {
+			mappingIndex = i + 1
+			break
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      makeVolumeID(b.name, target.TargetID, mappingIndex, lun.UUID),
+			CapacityBytes: lun.Size,
+			VolumeContext: map[string]string{
+				"targetID":     fmt.Sprintf("%d", target.TargetID),
+				"iqn":          target.IQN,
+				"mappingIndex": fmt.Sprintf("%d", mappingIndex),
+			},
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: b.accessibleTopology(),
+		},
+	}, nil
+}
+
+// lunDescription returns the description of the LUN populated from the content source
+func lunDescription(contentSource *csi.VolumeContentSource) string {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		return fmt.Sprintf("%s volume from snapshot %s", lunNamePrefix, snapshot.GetSnapshotId())
+	} else if volume := contentSource.GetVolume(); volume != nil {
+		return fmt.Sprintf("%s volume from volume %s", lunNamePrefix, volume.GetVolumeId())
+	}
+	return fmt.Sprintf("%s volume", lunNamePrefix)
+}
+
+// checkExistingLun checks if the LUN created by a previous request is compatible with the parameters
+func checkExistingLun(
+	lun *iscsi.Lun,
+	location string,
+	requiredBytes int64,
+	limitBytes int64,
+	volType string,
+	description string,
+) error {
+	if lun.Location != location {
+		return fmt.Errorf("LUN is at %s, not at %s", lun.Location, location)
+	}
+	if lun.Size < requiredBytes {
+		return fmt.Errorf("LUN size %d is smaller than required bytes %d", lun.Size, requiredBytes)
+	}
+	if limitBytes != 0 && lun.Size > limitBytes {
+		return fmt.Errorf("LUN size %d exceeds the limit %d", lun.Size, limitBytes)
+	}
+	// DSM may return the type as a number, which we can not compare
+	if lunType, ok := lun.Type.(string); ok && volType != "" && lunType != volType {
+		return fmt.Errorf("LUN type is %s, not %s", lunType, volType)
+	}
+	// the source is compared only if it is recorded, as older versions did not record it
+	if lun.Description != "" && lun.Description != description {
+		return fmt.Errorf("LUN is described as \"%s\", not \"%s\"", lun.Description, description)
+	}
+
+	return nil
+}
+
+// ensureTarget returns the target the LUN is mapped to.
+// If the LUN is not mapped, it maps the LUN to the target of the name, which is created if missing.
+func (cs *controllerServer) ensureTarget(
+	wf *provisionWorkflow,
+	b *backend,
+	lun *iscsi.Lun,
+	targetName string,
+	targetIQN string,
+	secrets map[string]string,
+) (*iscsi.Target, error) {
+	targets, err := b.targetAPI.List()
+	if err != nil {
+		msg := fmt.Sprintf("Failed get list of targets: %v", err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	var target *iscsi.Target
+	for i := range targets {
+		for _, mappedLun := range targets[i].MappedLuns {
+			if mappedLun.LunUUID == lun.UUID {
+				return &targets[i], nil
 			}
 		}
 
-		if target == nil {
-			msg := fmt.Sprintf("Failed to find target mapped to LUN %s", lunName)
+		if targets[i].Name == targetName {
+			target = &targets[i]
+		}
+	}
+
+	if target != nil {
+		// a previous request failed to map the LUN
+		if len(target.MappedLuns) != 0 {
+			msg := fmt.Sprintf("Target %s(%d) is mapped to another LUN %s",
+				target.Name, target.TargetID, target.MappedLuns[0].LunUUID)
 			glog.V(3).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, status.Error(codes.AlreadyExists, msg)
 		}
 
+		glog.V(3).Infof("Found target %s(%d) without LUN, will map LUN %s to it",
+			target.Name, target.TargetID, lun.UUID)
 	} else {
 		// create a target
-		secrets := req.GetSecrets()
-		user, present := secrets["user"]
-		if present {
-			password, present := secrets["password"]
-			if !present {
-				glog.V(3).Info("Password is required to provide chap authentication")
-				return nil, status.Error(codes.InvalidArgument, "Password is missing")
-			}
-			target, err = cs.targetAPI.Create(
-				targetName,
-				targetIQN,
-				iscsi.TargetAuthTypeNone,
-				user, password,
-			)
-		} else {
-			target, err = cs.targetAPI.Create(
-				targetName,
-				targetIQN,
-				iscsi.TargetAuthTypeNone,
-				"", "",
-			)
+		chap, err := parseChapSecrets(secrets)
+		if err != nil {
+			glog.V(3).Infof("Invalid chap secrets: %v", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 
+		target, err = b.targetAPI.Create(
+			targetName,
+			targetIQN,
+			chap.authType,
+			chap.user, chap.password,
+			chap.mutualUser, chap.mutualPassword,
+		)
+
 		if err != nil {
 			msg := fmt.Sprintf(
 				"Failed to create target(name: %s, iqn: %s): %v",
 				targetName, targetIQN, err)
 			glog.V(3).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, apiErrorStatus(err, msg)
 		}
 
 		glog.V(5).Infof("Target %s(ID: %d) created", targetName, target.TargetID)
 
-		// map lun
-		err = cs.targetAPI.MapLun(
-			target.TargetID, []string{lun.UUID})
+		targetID := target.TargetID
+		wf.done(fmt.Sprintf("created target %s(%d)", targetName, targetID), func() error {
+			return b.targetAPI.Delete(targetID)
+		})
+	}
+
+	// nodes are allowed to access the target when the volume is published
+	err = b.targetAPI.SetACLs(target.TargetID, []iscsi.TargetACL{
+		{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionNoAccess},
+	})
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to restrict access to target %s(%d): %v", target.Name, target.TargetID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	// map lun
+	err = b.targetAPI.MapLun(
+		target.TargetID, []string{lun.UUID})
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to map LUN %s(%s) to target %s(%d): %v",
+			lun.Name, lun.UUID, target.Name, target.TargetID, err)
+		glog.V(5).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	glog.V(5).Infof("Mapped LUN %s(%s) to target %s(ID: %d)",
+		lun.Name, lun.UUID, target.Name, target.TargetID)
+
+	targetID := target.TargetID
+	wf.done(fmt.Sprintf("mapped LUN %s to target %d", lun.UUID, targetID), func() error {
+		return b.targetAPI.UnmapLun(targetID, []string{lun.UUID})
+	})
+
+	// refresh the target to get the mapping
+	target, err = b.targetAPI.Get(target.TargetID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get target %s: %v", targetName, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	return target, nil
+}
+
+// getSourceSnapshot returns the snapshot to populate a volume on the backend from
+func (cs *controllerServer) getSourceSnapshot(b *backend, snapshotID string) (*iscsi.Snapshot, error) {
+	srcBackend, snapshotUUID, err := cs.findSnapshotBackend(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if srcBackend != b {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"Snapshot %s is not on the backend %s", snapshotID, b.name)
+	}
+
+	snapshot, err := b.snapshotAPI.Get(snapshotUUID)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to find snapshot %s: %v", snapshotID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	return snapshot, nil
+}
+
+// cloneLun creates a LUN from the snapshot or the volume of the content source,
+// and expands it to the requested capacity
+func (cs *controllerServer) cloneLun(
+	wf *provisionWorkflow,
+	b *backend,
+	lunName string,
+	location string,
+	capRange *csi.CapacityRange,
+	contentSource *csi.VolumeContentSource,
+) (*iscsi.Lun, error) {
+	var srcSize int64
+	var clone func() (*iscsi.Lun, error)
+
+	if srcSnapshot := contentSource.GetSnapshot(); srcSnapshot != nil {
+		snapshot, err := cs.getSourceSnapshot(b, srcSnapshot.GetSnapshotId())
 		if err != nil {
-			msg := fmt.Sprintf(
-				"Failed to map LUN %s(%s) to target %s(%d): %v",
-				lun.Name, lun.UUID, target.Name, target.TargetID, err)
-			glog.V(5).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, err
 		}
 
-		glog.V(5).Infof("Mapped LUN %s(%s) to target %s(ID: %d)",
-			lun.Name, lun.UUID, target.Name, target.TargetID)
+		srcSize = snapshot.TotalSize
+		clone = func() (*iscsi.Lun, error) {
+			return b.lunAPI.CloneSnapshot(snapshot.ParentUUID, snapshot.UUID, lunName)
+		}
+	} else if srcVolume := contentSource.GetVolume(); srcVolume != nil {
+		srcBackend, _, srcLun, err := cs.findVolume(srcVolume.GetVolumeId())
+		if err != nil {
+			return nil, err
+		}
+		if srcBackend != b {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"Volume %s is not on the backend %s", srcVolume.GetVolumeId(), b.name)
+		}
 
+		srcSize = srcLun.Size
+		clone = func() (*iscsi.Lun, error) {
+			return b.lunAPI.Clone(srcLun.UUID, lunName, location)
+		}
+	} else {
+		return nil, status.Error(codes.InvalidArgument, "Unsupported volume content source")
 	}
 
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId:      makeVolumeID(target.TargetID, 1),
-			CapacityBytes: volSizeByte,
-			VolumeContext: map[string]string{
-				"targetID":     fmt.Sprintf("%d", target.TargetID),
-				"iqn":          target.IQN,
-				"mappingIndex": "1",
-			},
-		},
-	}, nil
+	// the new volume must be able to hold the source
+	volSizeByte := capRange.GetRequiredBytes()
+	if volSizeByte == 0 {
+		volSizeByte = srcSize
+	}
+	if volSizeByte < srcSize {
+		return nil, status.Errorf(codes.OutOfRange,
+			"Requested size %d is smaller than the size of the source %d", volSizeByte, srcSize)
+	}
+	if limitBytes := capRange.GetLimitBytes(); limitBytes != 0 && srcSize > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange,
+			"Size of the source %d exceeds the limit %d", srcSize, limitBytes)
+	}
+
+	lun, err := clone()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to clone a LUN(name: %s): %v", lunName, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	wf.done(fmt.Sprintf("cloned LUN %s(%s)", lun.Name, lun.UUID), func() error {
+		return b.lunAPI.Delete(lun.UUID)
+	})
+
+	if volSizeByte > lun.Size {
+		if err = b.lunAPI.Update(lun.UUID, volSizeByte); err != nil {
+			msg := fmt.Sprintf("Failed to expand cloned LUN %s(%s) to %d: %v",
+				lun.Name, lun.UUID, volSizeByte, err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		lun.Size = volSizeByte
+	}
+
+	return lun, nil
 }
 
 // DeleteVolume deletes the LUN and the target created for the volume
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 
 	volID := req.GetVolumeId()
-	targetID, mappingIndex, err := parseVolumeID(volID)
+	b, target, lun, err := cs.findVolume(volID)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, err
 	}
 
-	target, err := cs.targetAPI.Get(targetID)
+	// snapshots are deleted with the LUN by DSM, and can not be restored without it
+	snapshots, err := b.snapshotAPI.List(lun.UUID)
 	if err != nil {
-		msg := fmt.Sprintf(
-			"Unable to find target of ID(%d): %v", targetID, err)
+		msg := fmt.Sprintf("Failed to list snapshots of LUN %s(%s): %v", lun.Name, lun.UUID, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.NotFound, msg)
+		return nil, apiErrorStatus(err, msg)
 	}
-
-	if len(target.MappedLuns) < mappingIndex {
-		msg := fmt.Sprintf("Target %s(%d) does not have mapping for index %d",
-			target.Name, target.TargetID, mappingIndex)
+	if len(snapshots) > 0 {
+		msg := fmt.Sprintf("Volume %s has %d snapshots, which must be deleted first", volID, len(snapshots))
 		glog.V(3).Info(msg)
 		return nil, status.Error(codes.FailedPrecondition, msg)
 	}
 
-	mapping := target.MappedLuns[mappingIndex-1]
-	lun, err := cs.lunAPI.Get(mapping.LunUUID)
-	if err != nil {
-		msg := fmt.Sprintf(
-			"Unable to find LUN of UUID: %s(mapped to target %s(%d))",
-			mapping.LunUUID, target.Name, target.TargetID)
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.NotFound, msg)
-	}
-
 	// unmap lun
-	err = cs.targetAPI.UnmapLun(target.TargetID, []string{lun.UUID})
+	err = b.targetAPI.UnmapLun(target.TargetID, []string{lun.UUID})
 	if err != nil {
 		msg := fmt.Sprintf(
 			"Failed to unmap LUN %s(%s) to target %s(%d): %v",
 			lun.Name, lun.UUID, target.Name, target.TargetID, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, apiErrorStatus(err, msg)
 	}
 
 	glog.V(5).Infof("Unmapped LUN %s(%s) to target %s(ID: %d)",
 		lun.Name, lun.UUID, target.Name, target.TargetID)
 
 	// delete target
-	err = cs.targetAPI.Delete(target.TargetID)
+	err = b.targetAPI.Delete(target.TargetID)
 	if err != nil {
 		msg := fmt.Sprintf(
 			"Failed to delete target %s(%d): %v",
 			target.Name, target.TargetID, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, apiErrorStatus(err, msg)
 	}
 	glog.V(5).Infof("Deleted target %s(%d)",
 		target.Name, target.TargetID)
 
 	// delete lun
-	err = cs.lunAPI.Delete(lun.UUID)
+	err = b.lunAPI.Delete(lun.UUID)
 	if err != nil {
 		msg := fmt.Sprintf(
 			"Failed to delete lun %s(%s): %v",
 			lun.Name, lun.UUID, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, apiErrorStatus(err, msg)
 	}
 	glog.V(5).Infof("Deleted lun %s(%s)",
 		lun.Name, lun.UUID)
@@ -378,61 +628,685 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// ControllerPublishVolume allows the initiator of the node to access the target of the volume
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// nothing needs to be done
+	volID := req.GetVolumeId()
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+
+	nodeID := req.GetNodeId()
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID is required")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
+	}
+
+	if !isInitiatorName(nodeID) {
+		msg := fmt.Sprintf("Node %s does not report its initiator name, upgrade the node plugin", nodeID)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.NotFound, msg)
+	}
+
+	// the ACLs are read and written back as a whole
+	defer cs.publishLocks.lock(volID)()
+
+	b, target, _, err := cs.findVolume(volID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cs.validateVolumeCapability(volCap); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mode := volCap.GetAccessMode().GetMode()
+	permission := iscsi.TargetPermissionReadWrite
+	if req.GetReadonly() || isReadOnlyMode(mode) {
+		permission = iscsi.TargetPermissionReadOnly
+	}
+
+	acls, changed, err := grantInitiator(target.ACLs, nodeID, permission, isSingleNodeMode(mode))
+	if err == errPublishedToOtherNode {
+		msg := fmt.Sprintf("Volume %s is published to another node: %v", volID, target.ACLs)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	} else if err == errIncompatiblePublish {
+		msg := fmt.Sprintf("Volume %s is published to node %s without %s permission", volID, nodeID, permission)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.AlreadyExists, msg)
+	}
+
+	if changed {
+		if err = b.targetAPI.SetACLs(target.TargetID, acls); err != nil {
+			msg := fmt.Sprintf("Failed to allow %s to access target %s(%d): %v",
+				nodeID, target.Name, target.TargetID, err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		glog.V(5).Infof("Allowed %s(%s) to access target %s(%d)",
+			nodeID, permission, target.Name, target.TargetID)
+	}
+
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+// ControllerUnpublishVolume removes the initiator of the node from the ACLs of the target
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volID := req.GetVolumeId()
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+
+	nodeID := req.GetNodeId()
+	if !isInitiatorName(nodeID) {
+		// the volume was published by an older version of the driver,
+		// or to all nodes when the node ID is empty, which we do not support
+		glog.V(3).Infof("Node %s is not an initiator name, nothing to unpublish", nodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	defer cs.publishLocks.lock(volID)()
+
+	b, target, _, err := cs.findVolume(volID)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			glog.V(3).Infof("Volume %s is not found, assume it is unpublished: %v", volID, err)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, err
+	}
+
+	acls, changed := revokeInitiator(target.ACLs, nodeID)
+	if changed {
+		if err = b.targetAPI.SetACLs(target.TargetID, acls); err != nil {
+			msg := fmt.Sprintf("Failed to remove %s from ACLs of target %s(%d): %v",
+				nodeID, target.Name, target.TargetID, err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		glog.V(5).Infof("Removed %s from ACLs of target %s(%d)", nodeID, target.Name, target.TargetID)
+	}
+
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// ListVolumes lists volumes created by the driver,
+// it queries all LUNs and targets of a backend at once
 func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	targets, err := cs.targetAPI.List()
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, b := range cs.backends {
+		targets, err := b.targetAPI.List()
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list targets: %v", err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		luns, err := b.lunAPI.List()
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list LUNs: %v", err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		lunsByUUID := map[string]*iscsi.Lun{}
+		for i := range luns {
+			lunsByUUID[luns[i].UUID] = &luns[i]
+		}
+
+		for _, t := range targets {
+
+			if !strings.HasPrefix(t.Name, targetNamePrefix) {
+				// I was not able to find a good way to flag volumes created by csi
+				// other than using prefix..
+				continue
+			}
+
+			for _, mapping := range t.MappedLuns {
+				lun, ok := lunsByUUID[mapping.LunUUID]
+				if !ok {
+					glog.V(3).Infof("LUN %s mapped to target %s(%d) is not found",
+						mapping.LunUUID, t.Name, t.TargetID)
+					continue
+				}
+
+				entry := csi.ListVolumesResponse_Entry{
+					Volume: &csi.Volume{
+						VolumeId:      makeVolumeID(b.name, t.TargetID, mapping.MappingIndex, mapping.LunUUID),
+						CapacityBytes: lun.Size,
+						VolumeContext: map[string]string{
+							"targetID":     fmt.Sprintf("%d", t.TargetID),
+							"iqn":          t.IQN,
+							"mappingIndex": fmt.Sprintf("%d", mapping.MappingIndex),
+						},
+						AccessibleTopology: b.accessibleTopology(),
+					},
+					Status: &csi.ListVolumesResponse_VolumeStatus{
+						PublishedNodeIds: connectedInitiators(&t),
+					},
+				}
+
+				entries = append(entries, &entry)
+			}
+		}
+	}
+
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
 	if err != nil {
-		msg := fmt.Sprintf("Failed to list targets: %v", err)
+		return nil, err
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// connectedInitiators returns initiators having sessions to the target,
+// which are IDs of the nodes the volume is published to
+func connectedInitiators(t *iscsi.Target) []string {
+	var initiators []string
+	seen := map[string]bool{}
+	for _, session := range t.ConnectedSessions {
+		// an initiator has a session for each portal with multipath
+		if !seen[session.IQN] {
+			seen[session.IQN] = true
+			initiators = append(initiators, session.IQN)
+		}
+	}
+	return initiators
+}
+
+// paginate returns the range of entries to return, and the token of the next page.
+// The token is the index of the first entry of the page
+func paginate(total int, startingToken string, maxEntries int32) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "Invalid max entries: %d", maxEntries)
+	}
+
+	start := 0
+	if len(startingToken) != 0 {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "Invalid starting token: %s", startingToken)
+		}
+	}
+
+	end := total
+	nextToken := ""
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+
+	return start, end, nextToken, nil
+}
+
+// ValidateVolumeCapabilities checks if the volume exists on the NAS, and supports the given capabilities
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volID := req.GetVolumeId()
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+
+	caps := req.GetVolumeCapabilities()
+	if len(caps) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities are required")
+	}
+
+	b, target, lun, err := cs.findVolume(volID)
+	if err != nil {
+		return nil, err
+	}
+
+	notConfirmed := func(msg string) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+		glog.V(3).Infof("Volume %s is not confirmed: %s", volID, msg)
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: msg,
+		}, nil
+	}
+
+	params := req.GetParameters()
+	if name, ok := params["backend"]; ok && name != b.name {
+		return notConfirmed(fmt.Sprintf("Volume is on backend %s, not on %s", b.name, name))
+	}
+	if location, ok := params["location"]; ok && location != lun.Location {
+		return notConfirmed(fmt.Sprintf("Volume is at %s, not at %s", lun.Location, location))
+	}
+
+	publishedNodes := len(grantedInitiators(target.ACLs))
+	for _, c := range caps {
+		if err := cs.validateVolumeCapability(c); err != nil {
+			return notConfirmed(err.Error())
+		}
+
+		mode := c.GetAccessMode().GetMode()
+		if isSingleNodeMode(mode) && publishedNodes > 1 {
+			return notConfirmed(fmt.Sprintf(
+				"Volume is published to %d nodes, which is not allowed for %s", publishedNodes, mode))
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: caps,
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// validateVolumeCapability checks the access type and the access mode of the capability
+func (cs *controllerServer) validateVolumeCapability(c *csi.VolumeCapability) error {
+	if c.GetBlock() == nil && c.GetMount() == nil {
+		return fmt.Errorf("unsupported access type")
+	}
+
+	mode := c.GetAccessMode().GetMode()
+	supported := false
+	for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+		if m.GetMode() == mode {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported access mode: %s", mode)
+	}
+
+	if isReadOnlyMode(mode) {
+		for _, flag := range c.GetMount().GetMountFlags() {
+			if flag == "rw" {
+				return fmt.Errorf("mount flag rw is not allowed for access mode %s", mode)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// GetCapacity returns free space of the storage volume at the location.
+// If the topology is given, it is the capacity of the backend CreateVolume selects for the topology.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	params := req.GetParameters()
+
+	var requirements *csi.TopologyRequirement
+	if topology := req.GetAccessibleTopology(); topology != nil {
+		requirements = &csi.TopologyRequirement{Requisite: []*csi.Topology{topology}}
+	}
+
+	b, err := cs.backends.selectBackend(params["backend"], requirements)
+	if err == errNoAccessibleBackend {
+		// volumes can not be created in the topology
+		glog.V(5).Infof("No backend is accessible from %v", req.GetAccessibleTopology().GetSegments())
+		return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	location, present := params["location"]
+	if !present {
+		location = defaultLocation
+	}
+
+	volume, err := getLocation(b, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: volume.SizeFreeByte,
+	}, nil
+}
+
+// getLocation returns the storage volume of the location
+func getLocation(b *backend, location string) (*storage.Volume, error) {
+	volume, err := b.volumeAPI.Get(location)
+	if err != nil {
+		volumes, listErr := b.volumeAPI.List()
+		if listErr != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Unable to list storage volumes: %v", listErr))
+		}
+
+		var locations []string
+		for _, vol := range volumes {
+			locations = append(locations, vol.VolumePath)
+		}
+
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Unable to find location %s, valid locations: %v", location, locations))
+	}
+
+	return volume, nil
+}
+
+// findVolume returns the backend, the target and the LUN for the given volume ID
+func (cs *controllerServer) findVolume(volID string) (*backend, *iscsi.Target, *iscsi.Lun, error) {
+	b, target, id, err := cs.backends.findTarget(volID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lun, err := b.lunAPI.Get(id.lunUUID)
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Unable to find LUN of UUID: %s(mapped to target %s(%d)): %v",
+			id.lunUUID, target.Name, target.TargetID, err)
 		glog.V(3).Info(msg)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, nil, nil, apiErrorStatus(err, msg)
 	}
 
-	var entries []*csi.ListVolumesResponse_Entry
-	for _, t := range targets {
+	return b, target, lun, nil
+}
 
-		if !strings.HasPrefix(t.Name, targetNamePrefix) {
-			// I was not able to find a good way to flag volumes created by csi
-			// other than using prefix..
+// findSnapshotBackend returns the backend and the UUID of the snapshot for the given snapshot ID
+func (cs *controllerServer) findSnapshotBackend(snapshotID string) (*backend, string, error) {
+	backendName, uuid, err := parseSnapshotID(snapshotID)
+	if err != nil {
+		return nil, "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	b, err := cs.backends.get(backendName)
+	if err != nil {
+		glog.V(3).Info(err.Error())
+		return nil, "", status.Error(codes.NotFound, err.Error())
+	}
+
+	return b, uuid, nil
+}
+
+// CreateSnapshot takes a snapshot of the LUN of the source volume
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name is required")
+	}
+
+	srcVolID := req.GetSourceVolumeId()
+	if len(srcVolID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID is required")
+	}
+
+	b, _, lun, err := cs.findVolume(srcVolID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotName := fmt.Sprintf("%s-%s", snapshotNamePrefix, name)
+
+	// check if snapshot already exists
+	snapshots, err := b.snapshotAPI.List(lun.UUID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list snapshots of LUN %s(%s): %v", lun.Name, lun.UUID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Name == snapshotName {
+			glog.V(3).Infof(
+				"Snapshot %s already exists for LUN %s, will use existing snapshot", snapshotName, lun.Name)
+
+			csiSnapshot, err := makeCSISnapshot(b, &snapshot, srcVolID)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}, nil
+		}
+	}
+
+	// the name must not be used by a snapshot of another volume
+	if err = checkSnapshotName(b, snapshotName, lun.UUID); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := b.snapshotAPI.Create(
+		lun.UUID, snapshotName, fmt.Sprintf("Snapshot of volume %s", srcVolID))
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to create a snapshot(name: %s) of LUN %s(%s): %v",
+			snapshotName, lun.Name, lun.UUID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	glog.V(5).Infof("Snapshot %s(%s) created from LUN %s(%s)",
+		snapshot.Name, snapshot.UUID, lun.Name, lun.UUID)
+
+	csiSnapshot, err := makeCSISnapshot(b, snapshot, srcVolID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}, nil
+}
+
+// checkSnapshotName fails with AlreadyExists if a snapshot of the name is taken from another LUN of the backend.
+// DSM can not find snapshots by name, so that snapshots of each volume on the backend are listed,
+// which costs a request per volume. It is done only before taking a new snapshot,
+// as retried requests find the snapshot on the source LUN first.
+func checkSnapshotName(b *backend, snapshotName string, lunUUID string) error {
+	volumes, err := listBackendVolumeLuns(b)
+	if err != nil {
+		return err
+	}
+
+	for _, vol := range volumes {
+		if vol.lunUUID == lunUUID {
 			continue
 		}
 
-		for _, mapping := range t.MappedLuns {
-			lun, err := cs.lunAPI.Get(mapping.LunUUID)
-			if err != nil {
-				msg := fmt.Sprintf("Failed to get LUN(%s): %v", mapping.LunUUID, err)
-				glog.V(3).Info(msg)
-				return nil, status.Error(codes.Internal, msg)
+		snapshots, err := vol.backend.snapshotAPI.List(vol.lunUUID)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots of LUN %s: %v", vol.lunUUID, err)
+			glog.V(3).Info(msg)
+			return apiErrorStatus(err, msg)
+		}
 
+		for _, snapshot := range snapshots {
+			if snapshot.Name == snapshotName {
+				msg := fmt.Sprintf("Snapshot %s already exists for another volume %s", snapshotName, vol.volumeID)
+				glog.V(3).Info(msg)
+				return status.Error(codes.AlreadyExists, msg)
 			}
-			if lun == nil {
+		}
+	}
+
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot of a LUN
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotID := req.GetSnapshotId()
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID is required")
+	}
+
+	b, uuid, err := cs.findSnapshotBackend(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := b.snapshotAPI.Get(uuid)
+	if isNotFound(err) {
+		// the snapshot is already gone
+		glog.V(3).Infof("Unable to find snapshot %s, assume it is deleted: %v", snapshotID, err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to get snapshot %s: %v", snapshotID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	if err = b.snapshotAPI.Delete(snapshot.UUID); err != nil {
+		msg := fmt.Sprintf(
+			"Failed to delete snapshot %s(%s): %v", snapshot.Name, snapshot.UUID, err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	glog.V(5).Infof("Deleted snapshot %s(%s)", snapshot.Name, snapshot.UUID)
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists snapshots of LUNs created by the driver
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	volumes, err := cs.listVolumeLuns()
+	if err != nil {
+		return nil, err
+	}
+
+	srcVolID := req.GetSourceVolumeId()
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	appendEntry := func(b *backend, snapshot *iscsi.Snapshot, volID string) error {
+		csiSnapshot, err := makeCSISnapshot(b, snapshot, volID)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot})
+		return nil
+	}
+
+	if snapshotID := req.GetSnapshotId(); len(snapshotID) != 0 {
+		b, uuid, err := cs.findSnapshotBackend(snapshotID)
+		if err != nil {
+			glog.V(3).Infof("Unable to find snapshot %s: %v", snapshotID, err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+
+		snapshot, err := b.snapshotAPI.Get(uuid)
+		if isNotFound(err) {
+			glog.V(3).Infof("Unable to find snapshot %s: %v", snapshotID, err)
+			return &csi.ListSnapshotsResponse{}, nil
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to get snapshot %s: %v", snapshotID, err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		for _, vol := range volumes {
+			if vol.backend != b || vol.lunUUID != snapshot.ParentUUID {
 				continue
 			}
+			if len(srcVolID) != 0 && srcVolID != vol.volumeID {
+				break
+			}
 
-			entry := csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{
-					VolumeId:      fmt.Sprintf("%d.%d", t.TargetID, mapping.MappingIndex),
-					CapacityBytes: lun.Size,
-					VolumeContext: map[string]string{
-						"targetID":     fmt.Sprintf("%d", t.TargetID),
-						"iqn":          t.IQN,
-						"mappingIndex": fmt.Sprintf("%d", mapping.MappingIndex),
-					},
-				},
+			if err = appendEntry(b, snapshot, vol.volumeID); err != nil {
+				return nil, err
 			}
+			break
+		}
+
+		return &csi.ListSnapshotsResponse{Entries: entries}, nil
+	}
 
-			entries = append(entries, &entry)
+	for _, vol := range volumes {
+		if len(srcVolID) != 0 && srcVolID != vol.volumeID {
+			continue
+		}
+
+		snapshots, err := vol.backend.snapshotAPI.List(vol.lunUUID)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots of LUN %s: %v", vol.lunUUID, err)
+			glog.V(3).Info(msg)
+			return nil, apiErrorStatus(err, msg)
+		}
+
+		for i := range snapshots {
+			if err = appendEntry(vol.backend, &snapshots[i], vol.volumeID); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return &csi.ListVolumesResponse{
-		Entries: entries,
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+type volumeLun struct {
+	backend  *backend
+	volumeID string
+	lunUUID  string
+}
+
+// listVolumeLuns returns LUNs mapped to targets created by the driver
+func (cs *controllerServer) listVolumeLuns() ([]volumeLun, error) {
+	var volumes []volumeLun
+	for _, b := range cs.backends {
+		backendVolumes, err := listBackendVolumeLuns(b)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, backendVolumes...)
+	}
+
+	return volumes, nil
+}
+
+// listBackendVolumeLuns returns LUNs of the backend mapped to targets created by the driver
+func listBackendVolumeLuns(b *backend) ([]volumeLun, error) {
+	targets, err := b.targetAPI.List()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list targets: %v", err)
+		glog.V(3).Info(msg)
+		return nil, apiErrorStatus(err, msg)
+	}
+
+	var volumes []volumeLun
+	for _, t := range targets {
+		if !strings.HasPrefix(t.Name, targetNamePrefix) {
+			continue
+		}
+
+		for _, mapping := range t.MappedLuns {
+			volumes = append(volumes, volumeLun{
+				backend:  b,
+				volumeID: makeVolumeID(b.name, t.TargetID, mapping.MappingIndex, mapping.LunUUID),
+				lunUUID:  mapping.LunUUID,
+			})
+		}
+	}
+
+	return volumes, nil
+}
+
+func makeCSISnapshot(b *backend, snapshot *iscsi.Snapshot, sourceVolumeID string) (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(time.Unix(snapshot.CreateTime, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     makeSnapshotID(b.name, snapshot.UUID),
+		SourceVolumeId: sourceVolumeID,
+		SizeBytes:      snapshot.TotalSize,
+		CreationTime:   creationTime,
+		ReadyToUse:     snapshot.Status == iscsi.SnapshotStatusHealthy,
 	}, nil
 }
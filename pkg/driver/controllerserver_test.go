@@ -0,0 +1,563 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+func newTestControllerServer(backends backendList) *controllerServer {
+	csiDriver := csicommon.NewCSIDriver(DriverName, version, "test-node")
+	csiDriver.AddVolumeCapabilityAccessModes(supportedAccessModes)
+
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(csiDriver),
+		backends:                backends,
+	}
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func blockCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestValidateVolumeCapability(t *testing.T) {
+	cs := newTestControllerServer(nil)
+
+	for _, c := range []*csi.VolumeCapability{
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rw"),
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "noatime"),
+		blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+	} {
+		assert.Nil(t, cs.validateVolumeCapability(c), c.String())
+	}
+
+	for _, c := range []*csi.VolumeCapability{
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER),
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "rw"),
+		blockCapability(csi.VolumeCapability_AccessMode_UNKNOWN),
+		{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+	} {
+		assert.NotNil(t, cs.validateVolumeCapability(c), c.String())
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+	volID := addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+
+	rwo := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	rox := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+	rwx := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+
+	resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{rwo, rox},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.GetConfirmed())
+	assert.Equal(t, []*csi.VolumeCapability{rwo, rox}, resp.GetConfirmed().GetVolumeCapabilities())
+
+	// unsupported access mode
+	resp, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{rwo, rwx},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.GetConfirmed())
+	assert.NotEmpty(t, resp.GetMessage())
+
+	// parameters of another location
+	resp, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{rwo},
+		Parameters:         map[string]string{"location": "/volume2"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.GetConfirmed())
+
+	// single node mode for a volume published to multiple nodes
+	targetAPI.targets[0].ACLs = []iscsi.TargetACL{
+		{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionNoAccess},
+		{IQN: "iqn.1993-08.org.debian:01:node1", Permission: iscsi.TargetPermissionReadOnly},
+		{IQN: "iqn.1993-08.org.debian:01:node2", Permission: iscsi.TargetPermissionReadOnly},
+	}
+	resp, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{rwo},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.GetConfirmed())
+
+	// missing volumes
+	lunUUID := lunAPI.luns[0].UUID
+	for _, id := range []string{
+		makeVolumeID("", 100, 1, lunUUID),
+		makeVolumeID("", targetAPI.targets[0].TargetID, 2, lunUUID),
+		makeVolumeID("", targetAPI.targets[0].TargetID, 1, "another-lun-uuid"),
+		makeVolumeID("nas2", targetAPI.targets[0].TargetID, 1, lunUUID),
+	} {
+		_, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           id,
+			VolumeCapabilities: []*csi.VolumeCapability{rwo},
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err), id)
+	}
+
+	_, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: volID,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestListVolumes(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	var volIDs []string
+	for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		volIDs = append(volIDs, addFakeVolume(b, lunAPI, targetAPI, name, defaultVolumeSize))
+	}
+	// targets not created by the driver are ignored
+	targetAPI.add("other-target", "iqn.2000-01.com.synology:other-target")
+
+	// an initiator has a session for each portal
+	node1 := "iqn.1993-08.org.debian:01:node1"
+	targetAPI.targets[0].ConnectedSessions = []iscsi.TargetSession{
+		{IQN: node1, IP: "10.0.1.1"},
+		{IQN: node1, IP: "10.0.2.1"},
+	}
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.GetEntries()))
+	assert.Equal(t, volIDs[0], resp.GetEntries()[0].GetVolume().GetVolumeId())
+	assert.Equal(t, defaultVolumeSize, resp.GetEntries()[0].GetVolume().GetCapacityBytes())
+	assert.Equal(t, []string{node1}, resp.GetEntries()[0].GetStatus().GetPublishedNodeIds())
+	assert.Empty(t, resp.GetEntries()[1].GetStatus().GetPublishedNodeIds())
+	assert.Equal(t, "2", resp.GetNextToken())
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{
+		MaxEntries:    2,
+		StartingToken: resp.GetNextToken(),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.GetEntries()))
+	assert.Equal(t, volIDs[2], resp.GetEntries()[0].GetVolume().GetVolumeId())
+	assert.Equal(t, "", resp.GetNextToken())
+
+	// LUNs are not queried one by one
+	assert.Equal(t, 2, lunAPI.calls["List"])
+	assert.Equal(t, 0, lunAPI.calls["Get"])
+	assert.Equal(t, 2, targetAPI.calls["List"])
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "10"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestCreateVolume(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	newRequest := func(name string, required int64, limit int64) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: required,
+				LimitBytes:    limit,
+			},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+		}
+	}
+
+	// repeated requests return the same volume
+	resp, err := cs.CreateVolume(context.Background(), newRequest("pvc-1", defaultVolumeSize, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultVolumeSize, resp.GetVolume().GetCapacityBytes())
+
+	again, err := cs.CreateVolume(context.Background(), newRequest("pvc-1", defaultVolumeSize/2, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, resp.GetVolume().GetVolumeId(), again.GetVolume().GetVolumeId())
+	// the actual capacity of the volume is returned
+	assert.Equal(t, defaultVolumeSize, again.GetVolume().GetCapacityBytes())
+	assert.Equal(t, 1, lunAPI.calls["Create"])
+	assert.Equal(t, 1, targetAPI.calls["Create"])
+	assert.Equal(t, 1, len(targetAPI.targets[0].MappedLuns))
+
+	// incompatible requests
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-1", defaultVolumeSize*2, 0))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-1", 0, defaultVolumeSize/2))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	req := newRequest("pvc-1", 0, 0)
+	req.Parameters = map[string]string{"provisioning": provisioningThick}
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// the default size is capped by the limit
+	resp, err = cs.CreateVolume(context.Background(), newRequest("pvc-2", 0, defaultVolumeSize/2))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultVolumeSize/2, resp.GetVolume().GetCapacityBytes())
+
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-3", defaultVolumeSize, defaultVolumeSize/2))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.CreateVolume(context.Background(), newRequest("", defaultVolumeSize, 0))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeRepair(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	newRequest := func(name string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: defaultVolumeSize},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+		}
+	}
+
+	// a LUN left without a target
+	lun := lunAPI.add(lunNamePrefix+"-pvc-1", defaultLocation, defaultVolumeSize, iscsi.LunTypeBlun)
+
+	resp, err := cs.CreateVolume(context.Background(), newRequest("pvc-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, lunAPI.calls["Create"])
+	assert.Equal(t, 1, targetAPI.calls["Create"])
+	assert.Equal(t, makeVolumeID("", targetAPI.targets[0].TargetID, 1, lun.UUID), resp.GetVolume().GetVolumeId())
+	assert.True(t, lun.IsMapped)
+
+	// a target left without a LUN
+	target := targetAPI.add(targetNamePrefix+"-pvc-2", iqnPrefix+"-pvc-2")
+
+	resp, err = cs.CreateVolume(context.Background(), newRequest("pvc-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, lunAPI.calls["Create"])
+	assert.Equal(t, 1, targetAPI.calls["Create"])
+	assert.Equal(t, 1, len(target.MappedLuns))
+	assert.Equal(t, makeVolumeID("", target.TargetID, 1, target.MappedLuns[0].LunUUID), resp.GetVolume().GetVolumeId())
+	// access is restricted as for new targets
+	assert.Equal(t, iscsi.TargetPermissionNoAccess, target.ACLs[0].Permission)
+
+	// a target of the name mapped to another LUN
+	other := lunAPI.add("other-lun", defaultLocation, defaultVolumeSize, iscsi.LunTypeBlun)
+	target = targetAPI.add(targetNamePrefix+"-pvc-3", iqnPrefix+"-pvc-3")
+	targetAPI.mapLun(target, other.UUID)
+
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-3"))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestCreateVolumeContentSource(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	snapshotAPI := b.snapshotAPI.(*fakeSnapshotAPI)
+	cs := newTestControllerServer(backendList{b})
+
+	srcVolID := addFakeVolume(b, lunAPI, targetAPI, "pvc-src", defaultVolumeSize)
+	snapshotID := makeSnapshotID(b.name, snapshotAPI.add(lunAPI.luns[0].UUID, "kube-csi-snapshot-1").UUID)
+
+	fromVolume := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcVolID},
+		},
+	}
+	fromSnapshot := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+	newRequest := func(name string, contentSource *csi.VolumeContentSource) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+			VolumeContentSource: contentSource,
+		}
+	}
+
+	// repeated requests return the same volume
+	resp, err := cs.CreateVolume(context.Background(), newRequest("pvc-1", fromVolume))
+	assert.Nil(t, err)
+	again, err := cs.CreateVolume(context.Background(), newRequest("pvc-1", fromVolume))
+	assert.Nil(t, err)
+	assert.Equal(t, resp.GetVolume().GetVolumeId(), again.GetVolume().GetVolumeId())
+	assert.Equal(t, 1, lunAPI.calls["Clone"])
+
+	// requests populating the volume from another source
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-1", fromSnapshot))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-1", nil))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	resp, err = cs.CreateVolume(context.Background(), newRequest("pvc-2", fromSnapshot))
+	assert.Nil(t, err)
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-2", fromVolume))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// an empty volume
+	req := newRequest("pvc-3", nil)
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: defaultVolumeSize}
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Nil(t, err)
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-3", fromSnapshot))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// the source of LUNs created by older versions is unknown
+	lunAPI.add(lunNamePrefix+"-pvc-4", defaultLocation, defaultVolumeSize, iscsi.LunTypeBlun)
+	_, err = cs.CreateVolume(context.Background(), newRequest("pvc-4", fromSnapshot))
+	assert.Nil(t, err)
+}
+
+func TestCreateVolumeFromSnapshotLocation(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	snapshotAPI := b.snapshotAPI.(*fakeSnapshotAPI)
+	volumeAPI := b.volumeAPI.(*fakeVolumeAPI)
+	volumeAPI.volumes = append(volumeAPI.volumes,
+		storage.Volume{VolumeId: 2, VolumePath: "/volume2", FSType: storage.FSTypeExt4, Status: "normal"})
+	cs := newTestControllerServer(backendList{b})
+
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-src", defaultVolumeSize)
+	lunAPI.luns[0].Location = "/volume2"
+	snapshot := snapshotAPI.add(lunAPI.luns[0].UUID, "kube-csi-snapshot-1")
+	snapshot.RootPath = "/volume2"
+
+	newRequest := func(params map[string]string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{
+						SnapshotId: makeSnapshotID(b.name, snapshot.UUID),
+					},
+				},
+			},
+			Parameters: params,
+		}
+	}
+
+	// DSM can not clone the snapshot to another location
+	_, err := cs.CreateVolume(context.Background(), newRequest(map[string]string{"location": defaultLocation}))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 0, lunAPI.calls["CloneSnapshot"])
+
+	// the volume is at the location of the snapshot, and retried requests return it
+	resp, err := cs.CreateVolume(context.Background(), newRequest(map[string]string{"provisioning": provisioningThick}))
+	assert.Nil(t, err)
+	assert.Equal(t, "/volume2", lunAPI.find(lunNamePrefix+"-pvc-1").Location)
+
+	again, err := cs.CreateVolume(context.Background(), newRequest(map[string]string{"provisioning": provisioningThick}))
+	assert.Nil(t, err)
+	assert.Equal(t, resp.GetVolume().GetVolumeId(), again.GetVolume().GetVolumeId())
+
+	again, err = cs.CreateVolume(context.Background(), newRequest(map[string]string{"location": "/volume2"}))
+	assert.Nil(t, err)
+	assert.Equal(t, resp.GetVolume().GetVolumeId(), again.GetVolume().GetVolumeId())
+	assert.Equal(t, 1, lunAPI.calls["CloneSnapshot"])
+}
+
+func TestDeleteVolume(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	snapshotAPI := b.snapshotAPI.(*fakeSnapshotAPI)
+	cs := newTestControllerServer(backendList{b})
+
+	volID := addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+	snapshot := snapshotAPI.add(lunAPI.luns[0].UUID, "kube-csi-snapshot-1")
+
+	// volumes with snapshots are not deleted
+	_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, 1, len(lunAPI.luns))
+	assert.Equal(t, 1, len(targetAPI.targets))
+	assert.Equal(t, 0, targetAPI.calls["UnmapLun"])
+
+	assert.Nil(t, snapshotAPI.Delete(snapshot.UUID))
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.Nil(t, err)
+	assert.Empty(t, lunAPI.luns)
+	assert.Empty(t, targetAPI.targets)
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	snapshotAPI := b.snapshotAPI.(*fakeSnapshotAPI)
+	other, otherLunAPI, otherTargetAPI := newFakeBackend("nas2")
+	cs := newTestControllerServer(backendList{b, other})
+
+	// only volumes of the backend are checked for the name
+	addFakeVolume(other, otherLunAPI, otherTargetAPI, "pvc-other", defaultVolumeSize)
+
+	volID1 := addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+	volID2 := addFakeVolume(b, lunAPI, targetAPI, "pvc-2", defaultVolumeSize)
+
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: volID1,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, volID1, resp.GetSnapshot().GetSourceVolumeId())
+
+	// retried requests return the same snapshot
+	retried, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: volID1,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.GetSnapshot().GetSnapshotId(), retried.GetSnapshot().GetSnapshotId())
+	assert.Equal(t, 1, snapshotAPI.calls["Create"])
+
+	// the name is used by the snapshot of another volume
+	_, err = cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: volID2,
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, 1, snapshotAPI.calls["Create"])
+	assert.Equal(t, 0, other.snapshotAPI.(*fakeSnapshotAPI).calls["List"])
+	assert.Equal(t, 0, otherTargetAPI.calls["List"])
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	snapshotAPI := b.snapshotAPI.(*fakeSnapshotAPI)
+	cs := newTestControllerServer(backendList{b})
+
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+	snapshotID := makeSnapshotID(b.name, snapshotAPI.add(lunAPI.luns[0].UUID, "kube-csi-snapshot-1").UUID)
+
+	// the snapshot is not deleted when DSM fails to find it
+	snapshotAPI.errs["Get"] = &core.APIError{
+		API: "SYNO.Core.ISCSI.LUN", Method: "get_snapshot", Code: core.ErrorCodeSessionTimeout}
+	_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Nil(t, resp)
+	assert.Equal(t, 1, len(snapshotAPI.snapshots))
+
+	delete(snapshotAPI.errs, "Get")
+	resp, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.GetEntries()))
+
+	_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	assert.Nil(t, err)
+	assert.Empty(t, snapshotAPI.snapshots)
+
+	// deleted snapshots are not found
+	_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	assert.Nil(t, err)
+
+	resp, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.GetEntries())
+}
+
+func TestControllerPublishVolumeConcurrent(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	publish := func(volID string, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) error {
+		_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volID,
+			NodeId:           nodeID,
+			VolumeCapability: mountCapability(mode),
+		})
+		return err
+	}
+	nodeID := func(i int) string {
+		return fmt.Sprintf("iqn.1993-08.org.debian:01:node%d", i)
+	}
+
+	// nodes publishing a volume at the same time are all allowed to access the target
+	volID := addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, publish(volID, nodeID(i), csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 10, len(grantedInitiators(targetAPI.targets[0].ACLs)))
+
+	// only one of the nodes can publish a single node volume
+	volID = addFakeVolume(b, lunAPI, targetAPI, "pvc-2", defaultVolumeSize)
+	var published int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := publish(volID, nodeID(i), csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			if err == nil {
+				atomic.AddInt32(&published, 1)
+			} else {
+				assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), published)
+	assert.Equal(t, 1, len(grantedInitiators(targetAPI.targets[1].ACLs)))
+}
@@ -25,8 +25,6 @@ import (
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 
-	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
-	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
 	"github.com/jparklab/synology-csi/pkg/synology/core"
 	"github.com/jparklab/synology-csi/pkg/synology/options"
 )
@@ -38,9 +36,21 @@ const (
 	version = "0.2.0"
 )
 
+var (
+	// supportedAccessModes contains access modes of volumes,
+	// volumes can not be written from multiple nodes as they have ext4 or btrfs file systems
+	supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	}
+)
+
 // Driver is top interface to run server
 type Driver interface {
 	Run()
+	// GarbageCollector returns a garbage collector sharing the sessions of the driver
+	GarbageCollector(gcOptions GCOptions) *GarbageCollector
 }
 
 type driver struct {
@@ -48,8 +58,12 @@ type driver struct {
 
 	endpoint string
 
-	synologyHost string
-	session      core.Session
+	backends backendList
+
+	// topology segments of the node
+	nodeTopology map[string]string
+	// file containing the initiator name of the node
+	initiatorNameFile string
 }
 
 func Login(synoOption *options.SynologyOptions) (*core.Session, string, error) {
@@ -64,38 +78,68 @@ func Login(synoOption *options.SynologyOptions) (*core.Session, string, error) {
 
 	glog.V(1).Infof("Use Synology: %s", synoAPIUrl)
 
-	session := core.NewSession(synoAPIUrl, synoOption.SessionName)
+	client, err := core.NewHTTPClient(synoOption)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := core.NewSession(synoAPIUrl, synoOption.SessionName, client)
 	loginResult, err := session.Login(synoOption)
 
 	return &session, loginResult, err
 }
 
-// NewDriver creates a Driver object
-func NewDriver(nodeID string, endpoint string, synoOption *options.SynologyOptions) (Driver, error) {
+// NewDriver creates a Driver object,
+// the first one of synoOptions is used for volumes that do not specify a backend
+func NewDriver(
+	nodeID string, endpoint string, nodeTopology map[string]string, initiatorNameFile string,
+	synoOptions []*options.SynologyOptions,
+) (Driver, error) {
 	glog.Infof("Driver: %v", DriverName)
 
-	session, _, err := Login(synoOption)
-	if err != nil {
-		glog.V(3).Infof("Failed to login: %v", err)
-		return nil, err
+	d := &driver{
+		endpoint:          endpoint,
+		nodeTopology:      nodeTopology,
+		initiatorNameFile: initiatorNameFile,
 	}
 
-	d := &driver{
-		endpoint:     endpoint,
-		synologyHost: synoOption.Host,
-		session:      *session,
+	// backends which can not be reached are kept, as their sessions log in again on requests,
+	// so that a NAS being down does not stop volumes on the others
+	var loginErr error
+	loggedIn := 0
+	for _, synoOption := range synoOptions {
+		session, _, err := Login(synoOption)
+		if session == nil {
+			glog.V(3).Infof("Failed to create a session for %s: %v", synoOption.Host, err)
+			return nil, err
+		}
+		if err != nil {
+			glog.Errorf("Failed to login to %s, will retry on requests: %v", synoOption.Host, err)
+			loginErr = err
+		} else {
+			loggedIn++
+		}
+
+		d.backends = append(d.backends, newBackend(synoOption, *session))
+	}
+	if loggedIn == 0 && loginErr != nil {
+		return nil, fmt.Errorf("Unable to login to any backend: %v", loginErr)
 	}
 
 	csiDriver := csicommon.NewCSIDriver(DriverName, version, nodeID)
 	csiDriver.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		})
-	csiDriver.AddVolumeCapabilityAccessModes(
-		[]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	csiDriver.AddVolumeCapabilityAccessModes(supportedAccessModes)
 
 	d.csiDriver = csiDriver
 
@@ -103,24 +147,37 @@ func NewDriver(nodeID string, endpoint string, synoOption *options.SynologyOptio
 }
 
 func (d *driver) Run() {
-	csicommon.RunControllerandNodePublishServer(d.endpoint, d.csiDriver, newControllerServer(d), newNodeServer(d))
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start(d.endpoint, newIdentityServer(d), newControllerServer(d), newNodeServer(d))
+	s.Wait()
+}
+
+// GarbageCollector returns a garbage collector of the backends of the driver.
+// It shares the sessions with the driver, as DSM may interrupt a session when the same user logs in again.
+func (d *driver) GarbageCollector(gcOptions GCOptions) *GarbageCollector {
+	return newGarbageCollector(d.backends, gcOptions)
+}
+
+func newIdentityServer(d *driver) *identityServer {
+	return &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d.csiDriver),
+	}
 }
 
 func newControllerServer(d *driver) *controllerServer {
 	glog.V(3).Infof("Create controller: %v", d.csiDriver)
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
-		lunAPI:                  iscsi.NewLunAPI(d.session),
-		targetAPI:               iscsi.NewTargetAPI(d.session),
-		volumeAPI:               storage.NewVolumeAPI(d.session),
+		backends:                d.backends,
 	}
 }
 
 func newNodeServer(d *driver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
-		lunAPI:            iscsi.NewLunAPI(d.session),
-		targetAPI:         iscsi.NewTargetAPI(d.session),
-		iscsiDrv:          iscsiDriver{synologyHost: d.synologyHost},
+		backends:          d.backends,
+		topology:          d.nodeTopology,
+		initiatorNameFile: d.initiatorNameFile,
+		stagedVolumeDir:   defaultStagedVolumeDir,
 	}
 }
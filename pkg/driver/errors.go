@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+// errorCode returns the gRPC code for the error returned by DSM web API,
+// errors of unknown codes and other errors(e.g. network errors) are mapped to Internal
+func errorCode(err error) codes.Code {
+	apiErr, ok := err.(*core.APIError)
+	if !ok {
+		return codes.Internal
+	}
+
+	switch apiErr.Code {
+	case core.ErrorCodeLunNotFound, core.ErrorCodeSnapshotNotFound, core.ErrorCodeTargetNotFound:
+		return codes.NotFound
+	case core.ErrorCodeLunNoSpace,
+		core.ErrorCodeLunReachMaxCount,
+		core.ErrorCodeTargetReachMaxCount,
+		core.ErrorCodeSnapshotReachMaxCount:
+		return codes.ResourceExhausted
+	case core.ErrorCodeLunDuplicatedName, core.ErrorCodeTargetDuplicatedName:
+		return codes.AlreadyExists
+	case core.ErrorCodeLunBadType, core.ErrorCodeInvalidParameter:
+		return codes.InvalidArgument
+	case core.ErrorCodeNoPermission:
+		return codes.PermissionDenied
+	case core.ErrorCodeSessionTimeout, core.ErrorCodeSessionInterrupted:
+		// the request has failed after logging in again, and can be retried later
+		return codes.Unavailable
+	}
+
+	return codes.Internal
+}
+
+// isNotFound returns true if DSM could not find the object
+func isNotFound(err error) bool {
+	return errorCode(err) == codes.NotFound
+}
+
+// apiErrorStatus returns a status error with the message, and the code for the error returned by DSM web API
+func apiErrorStatus(err error, msg string) error {
+	return status.Error(errorCode(err), msg)
+}
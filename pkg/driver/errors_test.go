@@ -0,0 +1,117 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+
+func TestErrorCode(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "get", Code: core.ErrorCodeLunNotFound}, codes.NotFound},
+		{&core.APIError{API: "SYNO.Core.ISCSI.Target", Method: "get", Code: core.ErrorCodeTargetNotFound}, codes.NotFound},
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "create", Code: core.ErrorCodeLunNoSpace}, codes.ResourceExhausted},
+		{&core.APIError{API: "SYNO.Core.ISCSI.Target", Method: "create", Code: core.ErrorCodeTargetReachMaxCount}, codes.ResourceExhausted},
+		{&core.APIError{API: "SYNO.Core.ISCSI.Target", Method: "create", Code: core.ErrorCodeTargetDuplicatedName}, codes.AlreadyExists},
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "create", Code: core.ErrorCodeLunBadType}, codes.InvalidArgument},
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "delete", Code: core.ErrorCodeNoPermission}, codes.PermissionDenied},
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "list", Code: core.ErrorCodeSessionTimeout}, codes.Unavailable},
+		{&core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "list", Code: 18990999}, codes.Internal},
+		{errors.New("connection refused"), codes.Internal},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, errorCode(tc.err), tc.err.Error())
+	}
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: defaultVolumeSize},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+	}
+
+	// failures to find the LUN are not taken as the LUN does not exist
+	b, lunAPI, _ := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+	lunAPI.errs["Get"] = &core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "get", Code: core.ErrorCodeNoPermission}
+
+	_, err := cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, 0, lunAPI.calls["Create"])
+
+	b, lunAPI, _ = newFakeBackend("")
+	cs = newTestControllerServer(backendList{b})
+	lunAPI.errs["Create"] = &core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: "create", Code: core.ErrorCodeLunNoSpace}
+
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestControllerUnpublishVolumeErrors(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	volID := addFakeVolume(b, lunAPI, targetAPI, "pvc-1", defaultVolumeSize)
+	req := &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   "iqn.1993-08.org.debian:01:node1",
+	}
+	_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volID,
+		NodeId:           req.NodeId,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, targetAPI.calls["SetACLs"])
+
+	// failures to find the target are not taken as the volume is deleted
+	targetAPI.errs["Get"] = &core.APIError{API: "SYNO.Core.ISCSI.Target", Method: "get", Code: core.ErrorCodeSessionTimeout}
+	_, err = cs.ControllerUnpublishVolume(context.Background(), req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, []string{req.NodeId}, grantedInitiators(targetAPI.targets[0].ACLs))
+
+	delete(targetAPI.errs, "Get")
+	_, err = cs.ControllerUnpublishVolume(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Empty(t, grantedInitiators(targetAPI.targets[0].ACLs))
+
+	// volumes whose target is deleted are unpublished
+	assert.Nil(t, targetAPI.Delete(targetAPI.targets[0].TargetID))
+	_, err = cs.ControllerUnpublishVolume(context.Background(), req)
+	assert.Nil(t, err)
+}
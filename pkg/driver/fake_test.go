@@ -0,0 +1,521 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/pborman/uuid"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+/************************************************************
+ * In-memory LunAPI, TargetAPI, SnapshotAPI and VolumeAPI for tests
+ ************************************************************/
+
+// errLunNotFound returns the error DSM returns for LUNs which do not exist
+func errLunNotFound(method string) error {
+	return &core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: method, Code: core.ErrorCodeLunNotFound}
+}
+
+type fakeLunAPI struct {
+	luns  []*iscsi.Lun
+	calls map[string]int
+	// errors returned by the methods
+	errs map[string]error
+}
+
+func newFakeLunAPI() *fakeLunAPI {
+	return &fakeLunAPI{
+		calls: map[string]int{},
+		errs:  map[string]error{},
+	}
+}
+
+func (l *fakeLunAPI) call(method string) error {
+	l.calls[method]++
+	return l.errs[method]
+}
+
+// find returns the LUN of the UUID or the name, as DSM accepts both
+func (l *fakeLunAPI) find(id string) *iscsi.Lun {
+	for _, lun := range l.luns {
+		if lun.UUID == id || lun.Name == id {
+			return lun
+		}
+	}
+	return nil
+}
+
+func (l *fakeLunAPI) add(name string, location string, size int64, volType string) *iscsi.Lun {
+	lun := &iscsi.Lun{
+		Location: location,
+		LunID:    len(l.luns) + 1,
+		Name:     name,
+		Size:     size,
+		Type:     volType,
+		UUID:     uuid.NewUUID().String(),
+		Status:   "normal",
+	}
+	l.luns = append(l.luns, lun)
+	return lun
+}
+
+func (l *fakeLunAPI) List() ([]iscsi.Lun, error) {
+	if err := l.call("List"); err != nil {
+		return nil, err
+	}
+
+	var luns []iscsi.Lun
+	for _, lun := range l.luns {
+		luns = append(luns, *lun)
+	}
+	return luns, nil
+}
+
+func (l *fakeLunAPI) Get(id string) (*iscsi.Lun, error) {
+	if err := l.call("Get"); err != nil {
+		return nil, err
+	}
+
+	lun := l.find(id)
+	if lun == nil {
+		return nil, errLunNotFound("get")
+	}
+	found := *lun
+	return &found, nil
+}
+
+func (l *fakeLunAPI) Create(name string, location string, size int64, volType string) (*iscsi.Lun, error) {
+	if err := l.call("Create"); err != nil {
+		return nil, err
+	}
+
+	lun := l.add(name, location, size, volType)
+	created := *lun
+	return &created, nil
+}
+
+func (l *fakeLunAPI) Delete(id string) error {
+	if err := l.call("Delete"); err != nil {
+		return err
+	}
+
+	for i, lun := range l.luns {
+		if lun.UUID == id {
+			l.luns = append(l.luns[:i], l.luns[i+1:]...)
+			return nil
+		}
+	}
+	return errLunNotFound("delete")
+}
+
+func (l *fakeLunAPI) Update(id string, size int64) error {
+	if err := l.call("Update"); err != nil {
+		return err
+	}
+
+	lun := l.find(id)
+	if lun == nil {
+		return errLunNotFound("set")
+	}
+	lun.Size = size
+	return nil
+}
+
+func (l *fakeLunAPI) SetDescription(id string, description string) error {
+	if err := l.call("SetDescription"); err != nil {
+		return err
+	}
+
+	lun := l.find(id)
+	if lun == nil {
+		return errLunNotFound("set")
+	}
+	lun.Description = description
+	return nil
+}
+
+func (l *fakeLunAPI) Clone(srcID string, name string, location string) (*iscsi.Lun, error) {
+	if err := l.call("Clone"); err != nil {
+		return nil, err
+	}
+
+	src := l.find(srcID)
+	if src == nil {
+		return nil, errLunNotFound("clone")
+	}
+	lun := l.add(name, location, src.Size, fmt.Sprintf("%v", src.Type))
+	cloned := *lun
+	return &cloned, nil
+}
+
+func (l *fakeLunAPI) CloneSnapshot(srcID string, snapshotID string, name string) (*iscsi.Lun, error) {
+	if err := l.call("CloneSnapshot"); err != nil {
+		return nil, err
+	}
+
+	src := l.find(srcID)
+	if src == nil {
+		return nil, errLunNotFound("clone_snapshot")
+	}
+	lun := l.add(name, src.Location, src.Size, fmt.Sprintf("%v", src.Type))
+	cloned := *lun
+	return &cloned, nil
+}
+
+// errTargetNotFound returns the error DSM returns for targets which do not exist
+func errTargetNotFound(method string) error {
+	return &core.APIError{API: "SYNO.Core.ISCSI.Target", Method: method, Code: core.ErrorCodeTargetNotFound}
+}
+
+type fakeTargetAPI struct {
+	targets []*iscsi.Target
+	nextID  int
+	calls   map[string]int
+	// errors returned by the methods
+	errs map[string]error
+	// luns are marked as mapped when they are mapped to targets
+	lunAPI *fakeLunAPI
+}
+
+func newFakeTargetAPI(lunAPI *fakeLunAPI) *fakeTargetAPI {
+	return &fakeTargetAPI{
+		nextID: 1,
+		calls:  map[string]int{},
+		errs:   map[string]error{},
+		lunAPI: lunAPI,
+	}
+}
+
+func (t *fakeTargetAPI) call(method string) error {
+	t.calls[method]++
+	return t.errs[method]
+}
+
+func (t *fakeTargetAPI) find(id int) *iscsi.Target {
+	for _, target := range t.targets {
+		if target.TargetID == id {
+			return target
+		}
+	}
+	return nil
+}
+
+func (t *fakeTargetAPI) add(name string, iqn string) *iscsi.Target {
+	target := &iscsi.Target{
+		Name:        name,
+		IQN:         iqn,
+		TargetID:    t.nextID,
+		MaxSessions: 1,
+		IsEnabled:   true,
+		Status:      "online",
+		ACLs: []iscsi.TargetACL{
+			{IQN: iscsi.TargetDefaultACLIQN, Permission: iscsi.TargetPermissionReadWrite},
+		},
+	}
+	t.nextID++
+	t.targets = append(t.targets, target)
+	return target
+}
+
+func (t *fakeTargetAPI) mapLun(target *iscsi.Target, lunUUID string) {
+	target.MappedLuns = append(target.MappedLuns, struct {
+		LunUUID      string `json:"lun_uuid"`
+		MappingIndex int    `json:"mapping_index"`
+	}{lunUUID, len(target.MappedLuns) + 1})
+
+	if lun := t.lunAPI.find(lunUUID); lun != nil {
+		lun.IsMapped = true
+	}
+}
+
+func (t *fakeTargetAPI) List() ([]iscsi.Target, error) {
+	if err := t.call("List"); err != nil {
+		return nil, err
+	}
+
+	var targets []iscsi.Target
+	for _, target := range t.targets {
+		targets = append(targets, *target)
+	}
+	return targets, nil
+}
+
+func (t *fakeTargetAPI) Get(id int) (*iscsi.Target, error) {
+	if err := t.call("Get"); err != nil {
+		return nil, err
+	}
+
+	target := t.find(id)
+	if target == nil {
+		return nil, errTargetNotFound("get")
+	}
+	found := *target
+	return &found, nil
+}
+
+func (t *fakeTargetAPI) Create(
+	name string, iqn string, authType int,
+	user string, password string, mutualUser string, mutualPassword string,
+) (*iscsi.Target, error) {
+	if err := t.call("Create"); err != nil {
+		return nil, err
+	}
+
+	for _, target := range t.targets {
+		if target.Name == name || target.IQN == iqn {
+			return nil, fmt.Errorf("Target %s already exists", name)
+		}
+	}
+
+	target := t.add(name, iqn)
+	target.AuthType = authType
+	target.User = user
+	target.Password = password
+	target.MutualUser = mutualUser
+	target.MutualPassword = mutualPassword
+
+	created := *target
+	return &created, nil
+}
+
+func (t *fakeTargetAPI) Delete(id int) error {
+	if err := t.call("Delete"); err != nil {
+		return err
+	}
+
+	for i, target := range t.targets {
+		if target.TargetID == id {
+			for _, mapping := range target.MappedLuns {
+				if lun := t.lunAPI.find(mapping.LunUUID); lun != nil {
+					lun.IsMapped = false
+				}
+			}
+			t.targets = append(t.targets[:i], t.targets[i+1:]...)
+			return nil
+		}
+	}
+	return errTargetNotFound("delete")
+}
+
+func (t *fakeTargetAPI) MapLun(targetID int, lunUUIDs []string) error {
+	if err := t.call("MapLun"); err != nil {
+		return err
+	}
+
+	target := t.find(targetID)
+	if target == nil {
+		return errTargetNotFound("map_lun")
+	}
+	for _, lunUUID := range lunUUIDs {
+		t.mapLun(target, lunUUID)
+	}
+	return nil
+}
+
+func (t *fakeTargetAPI) UnmapLun(targetID int, lunUUIDs []string) error {
+	if err := t.call("UnmapLun"); err != nil {
+		return err
+	}
+
+	target := t.find(targetID)
+	if target == nil {
+		return errTargetNotFound("unmap_lun")
+	}
+
+	for _, lunUUID := range lunUUIDs {
+		for i, mapping := range target.MappedLuns {
+			if mapping.LunUUID == lunUUID {
+				target.MappedLuns = append(target.MappedLuns[:i], target.MappedLuns[i+1:]...)
+				break
+			}
+		}
+		if lun := t.lunAPI.find(lunUUID); lun != nil {
+			lun.IsMapped = false
+		}
+	}
+	return nil
+}
+
+func (t *fakeTargetAPI) SetNetworkPortals(targetID int, portals []iscsi.NetworkPortal) error {
+	if err := t.call("SetNetworkPortals"); err != nil {
+		return err
+	}
+
+	target := t.find(targetID)
+	if target == nil {
+		return errTargetNotFound("set")
+	}
+	target.NetworkPortals = portals
+	return nil
+}
+
+func (t *fakeTargetAPI) SetACLs(targetID int, acls []iscsi.TargetACL) error {
+	if err := t.call("SetACLs"); err != nil {
+		return err
+	}
+
+	target := t.find(targetID)
+	if target == nil {
+		return errTargetNotFound("set")
+	}
+	target.ACLs = acls
+	return nil
+}
+
+func (t *fakeTargetAPI) RestrictInitiator(targetID int, iqn string, permission string) error {
+	return t.SetACLs(targetID, iscsi.RestrictedACLs(iqn, permission))
+}
+
+// errSnapshotNotFound returns the error DSM returns for snapshots which do not exist
+func errSnapshotNotFound(method string) error {
+	return &core.APIError{API: "SYNO.Core.ISCSI.LUN", Method: method, Code: core.ErrorCodeSnapshotNotFound}
+}
+
+type fakeSnapshotAPI struct {
+	snapshots []*iscsi.Snapshot
+	calls     map[string]int
+	// errors returned by the methods
+	errs map[string]error
+}
+
+func newFakeSnapshotAPI() *fakeSnapshotAPI {
+	return &fakeSnapshotAPI{
+		calls: map[string]int{},
+		errs:  map[string]error{},
+	}
+}
+
+func (s *fakeSnapshotAPI) call(method string) error {
+	s.calls[method]++
+	return s.errs[method]
+}
+
+func (s *fakeSnapshotAPI) add(lunUUID string, name string) *iscsi.Snapshot {
+	snapshot := &iscsi.Snapshot{
+		Name:       name,
+		UUID:       uuid.NewUUID().String(),
+		ParentUUID: lunUUID,
+		Status:     iscsi.SnapshotStatusHealthy,
+		RootPath:   defaultLocation,
+	}
+	s.snapshots = append(s.snapshots, snapshot)
+	return snapshot
+}
+
+func (s *fakeSnapshotAPI) List(lunUUID string) ([]iscsi.Snapshot, error) {
+	if err := s.call("List"); err != nil {
+		return nil, err
+	}
+
+	var snapshots []iscsi.Snapshot
+	for _, snapshot := range s.snapshots {
+		if snapshot.ParentUUID == lunUUID {
+			snapshots = append(snapshots, *snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+func (s *fakeSnapshotAPI) Get(id string) (*iscsi.Snapshot, error) {
+	if err := s.call("Get"); err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range s.snapshots {
+		if snapshot.UUID == id {
+			found := *snapshot
+			return &found, nil
+		}
+	}
+	return nil, errSnapshotNotFound("get_snapshot")
+}
+
+func (s *fakeSnapshotAPI) Create(lunUUID string, name string, description string) (*iscsi.Snapshot, error) {
+	if err := s.call("Create"); err != nil {
+		return nil, err
+	}
+
+	created := *s.add(lunUUID, name)
+	return &created, nil
+}
+
+func (s *fakeSnapshotAPI) Delete(id string) error {
+	if err := s.call("Delete"); err != nil {
+		return err
+	}
+
+	for i, snapshot := range s.snapshots {
+		if snapshot.UUID == id {
+			s.snapshots = append(s.snapshots[:i], s.snapshots[i+1:]...)
+			return nil
+		}
+	}
+	return errSnapshotNotFound("delete_snapshot")
+}
+
+type fakeVolumeAPI struct {
+	volumes []storage.Volume
+}
+
+func (v *fakeVolumeAPI) List() ([]storage.Volume, error) {
+	return v.volumes, nil
+}
+
+func (v *fakeVolumeAPI) Get(volumePath string) (*storage.Volume, error) {
+	for i := range v.volumes {
+		if v.volumes[i].VolumePath == volumePath {
+			found := v.volumes[i]
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("Volume %s not found", volumePath)
+}
+
+// newFakeBackend returns a backend using the fake APIs,
+// the snapshot API is a *fakeSnapshotAPI
+func newFakeBackend(name string) (*backend, *fakeLunAPI, *fakeTargetAPI) {
+	lunAPI := newFakeLunAPI()
+	targetAPI := newFakeTargetAPI(lunAPI)
+
+	return &backend{
+		name:        name,
+		host:        "127.0.0.1",
+		lunAPI:      lunAPI,
+		targetAPI:   targetAPI,
+		snapshotAPI: newFakeSnapshotAPI(),
+		volumeAPI: &fakeVolumeAPI{
+			volumes: []storage.Volume{
+				{VolumeId: 1, VolumePath: defaultLocation, FSType: storage.FSTypeBtrfs, Status: "normal"},
+			},
+		},
+	}, lunAPI, targetAPI
+}
+
+// addFakeVolume adds a LUN mapped to a target, and returns the volume ID
+func addFakeVolume(b *backend, lunAPI *fakeLunAPI, targetAPI *fakeTargetAPI, name string, size int64) string {
+	lun := lunAPI.add(fmt.Sprintf("%s-%s", lunNamePrefix, name), defaultLocation, size, iscsi.LunTypeBlun)
+	target := targetAPI.add(
+		fmt.Sprintf("%s-%s", targetNamePrefix, name), fmt.Sprintf("%s-%s", iqnPrefix, name))
+	targetAPI.mapLun(target, lun.UUID)
+
+	return makeVolumeID(b.name, target.TargetID, 1, lun.UUID)
+}
@@ -0,0 +1,380 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/options"
+)
+
+const (
+	// OrphanKindLun is the kind of orphaned LUNs
+	OrphanKindLun = "lun"
+	// OrphanKindTarget is the kind of orphaned targets
+	OrphanKindTarget = "target"
+)
+
+// GCOptions contains options of the garbage collector
+type GCOptions struct {
+	// report orphans without deleting them
+	DryRun bool
+	// orphans are deleted after they have been found for the duration
+	MinAge time.Duration
+	// file to keep the time orphans were found across runs, optional
+	StateFile string
+	// only LUNs and targets of the volumes whose names start with the prefix are collected,
+	// so that clusters sharing a NAS do not delete volumes of each other. All if empty
+	VolumeNamePrefix string
+}
+
+// Orphan is a LUN or a target created by the driver which does not belong to any volume
+type Orphan struct {
+	Backend string
+	Kind    string // see OrphanKind
+	Name    string
+	ID      string // UUID of the LUN, or ID of the target
+	// time since the orphan was found first
+	Age time.Duration
+
+	Deleted bool
+	// reason the orphan was not deleted
+	Skipped string
+}
+
+func (o *Orphan) key() string {
+	return fmt.Sprintf("%s/%s/%s", o.Backend, o.Kind, o.ID)
+}
+
+// GarbageCollector removes LUNs and targets left on the NAS by failed provisions or manual deletions
+type GarbageCollector struct {
+	backends backendList
+	options  GCOptions
+
+	// time orphans were found first, which is used as their age
+	// as DSM does not report when LUNs and targets were created
+	firstSeen map[string]time.Time
+	now       func() time.Time
+}
+
+// NewGarbageCollector creates a GarbageCollector logged in to the backends.
+// It is used by the gc command, which does not run with the driver; see Driver.GarbageCollector
+func NewGarbageCollector(synoOptions []*options.SynologyOptions, gcOptions GCOptions) (*GarbageCollector, error) {
+	var backends backendList
+	for _, synoOption := range synoOptions {
+		session, _, err := Login(synoOption)
+		if err != nil {
+			glog.V(3).Infof("Failed to login to %s: %v", synoOption.Host, err)
+			return nil, err
+		}
+
+		backends = append(backends, newBackend(synoOption, *session))
+	}
+
+	gc := newGarbageCollector(backends, gcOptions)
+	if err := gc.loadState(); err != nil {
+		return nil, err
+	}
+
+	return gc, nil
+}
+
+func newGarbageCollector(backends backendList, gcOptions GCOptions) *GarbageCollector {
+	return &GarbageCollector{
+		backends:  backends,
+		options:   gcOptions,
+		firstSeen: map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// Collect finds LUNs and targets which do not belong to the live volumes, and deletes them
+// unless it is a dry run or they have not been found for MinAge
+func (gc *GarbageCollector) Collect(liveVolumeIDs []string) ([]Orphan, error) {
+	live := map[*backend][]*volumeID{}
+	for _, volID := range liveVolumeIDs {
+		id, err := parseVolumeID(volID)
+		if err != nil {
+			// volumes of other drivers
+			glog.V(5).Infof("Ignoring volume %s: %v", volID, err)
+			continue
+		}
+
+		b, err := gc.backends.get(id.backendName)
+		if err != nil {
+			glog.Warningf("Ignoring volume %s: %v", volID, err)
+			continue
+		}
+		live[b] = append(live[b], id)
+	}
+
+	var orphans []Orphan
+	found := map[string]bool{}
+	for _, b := range gc.backends {
+		backendOrphans, err := gc.collectBackend(b, live[b], found)
+		if err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, backendOrphans...)
+	}
+
+	// forget objects which are gone or not orphans anymore
+	for key := range gc.firstSeen {
+		if !found[key] {
+			delete(gc.firstSeen, key)
+		}
+	}
+
+	if err := gc.saveState(); err != nil {
+		return orphans, err
+	}
+
+	return orphans, nil
+}
+
+func (gc *GarbageCollector) collectBackend(b *backend, liveIDs []*volumeID, found map[string]bool) ([]Orphan, error) {
+	targets, err := b.targetAPI.List()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list targets of %s: %v", b.host, err)
+	}
+	luns, err := b.lunAPI.List()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list LUNs of %s: %v", b.host, err)
+	}
+
+	liveTargets := map[int]bool{}
+	liveLuns := map[string]bool{}
+	for _, id := range liveIDs {
+		liveTargets[id.targetID] = true
+		if id.lunUUID != "" {
+			liveLuns[id.lunUUID] = true
+		}
+	}
+
+	// LUNs mapped to live targets are in use, even if volume IDs do not contain their UUIDs
+	mappedTo := map[string]int{}
+	for _, target := range targets {
+		for _, mapping := range target.MappedLuns {
+			mappedTo[mapping.LunUUID] = target.TargetID
+			if liveTargets[target.TargetID] {
+				liveLuns[mapping.LunUUID] = true
+			}
+		}
+	}
+
+	var orphans []Orphan
+	deletedTargets := map[int]bool{}
+	for _, target := range targets {
+		if !gc.collectable(target.Name, targetNamePrefix) || liveTargets[target.TargetID] {
+			continue
+		}
+
+		orphan := gc.newOrphan(b, OrphanKindTarget, target.Name, fmt.Sprintf("%d", target.TargetID), found)
+		if len(target.ConnectedSessions) > 0 {
+			orphan.Skipped = "connected"
+		} else if gc.deletable(&orphan) {
+			if err := deleteOrphanTarget(b, &target); err != nil {
+				glog.Errorf("Failed to delete target %s(%d): %v", target.Name, target.TargetID, err)
+				orphan.Skipped = err.Error()
+			} else {
+				orphan.Deleted = true
+				deletedTargets[target.TargetID] = true
+			}
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	for _, lun := range luns {
+		if !gc.collectable(lun.Name, lunNamePrefix) || liveLuns[lun.UUID] {
+			continue
+		}
+
+		orphan := gc.newOrphan(b, OrphanKindLun, lun.Name, lun.UUID, found)
+		if targetID, mapped := mappedTo[lun.UUID]; mapped && !deletedTargets[targetID] {
+			orphan.Skipped = fmt.Sprintf("mapped to target %d", targetID)
+		} else if gc.deletable(&orphan) {
+			if err := b.lunAPI.Delete(lun.UUID); err != nil {
+				glog.Errorf("Failed to delete LUN %s(%s): %v", lun.Name, lun.UUID, err)
+				orphan.Skipped = err.Error()
+			} else {
+				orphan.Deleted = true
+			}
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+// collectable returns true if the LUN or the target of the name is created by the driver for a volume of the cluster
+func (gc *GarbageCollector) collectable(name string, namePrefix string) bool {
+	volName := strings.TrimPrefix(name, namePrefix+"-")
+	if volName == name {
+		return false
+	}
+	// external-provisioner names volumes <prefix>-<UID of the PersistentVolumeClaim>
+	return gc.options.VolumeNamePrefix == "" || strings.HasPrefix(volName, gc.options.VolumeNamePrefix+"-")
+}
+
+func (gc *GarbageCollector) newOrphan(b *backend, kind string, name string, id string, found map[string]bool) Orphan {
+	orphan := Orphan{Backend: b.name, Kind: kind, Name: name, ID: id}
+
+	key := orphan.key()
+	found[key] = true
+
+	now := gc.now()
+	firstSeen, ok := gc.firstSeen[key]
+	if !ok {
+		firstSeen = now
+		gc.firstSeen[key] = now
+	}
+	orphan.Age = now.Sub(firstSeen)
+
+	return orphan
+}
+
+// deletable returns true if the orphan can be deleted, or sets the reason it can not
+func (gc *GarbageCollector) deletable(orphan *Orphan) bool {
+	if orphan.Age < gc.options.MinAge {
+		orphan.Skipped = fmt.Sprintf("found %s ago", orphan.Age.Round(time.Second))
+		return false
+	}
+	if gc.options.DryRun {
+		orphan.Skipped = "dry run"
+		return false
+	}
+	return true
+}
+
+func deleteOrphanTarget(b *backend, target *iscsi.Target) error {
+	var lunUUIDs []string
+	for _, mapping := range target.MappedLuns {
+		lunUUIDs = append(lunUUIDs, mapping.LunUUID)
+	}
+
+	if len(lunUUIDs) > 0 {
+		if err := b.targetAPI.UnmapLun(target.TargetID, lunUUIDs); err != nil {
+			return err
+		}
+	}
+
+	glog.V(3).Infof("Deleting orphaned target %s(%d)", target.Name, target.TargetID)
+	return b.targetAPI.Delete(target.TargetID)
+}
+
+// Run collects garbage periodically until stopCh is closed
+func (gc *GarbageCollector) Run(interval time.Duration, listVolumeIDs func() ([]string, error), stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		volumeIDs, err := listVolumeIDs()
+		if err != nil {
+			glog.Errorf("Failed to list volumes, skipping garbage collection: %v", err)
+		} else {
+			orphans, err := gc.Collect(volumeIDs)
+			if err != nil {
+				glog.Errorf("Failed to collect garbage: %v", err)
+			}
+			for _, orphan := range orphans {
+				if orphan.Deleted {
+					glog.Infof("Deleted orphaned %s %s(%s) on backend %s",
+						orphan.Kind, orphan.Name, orphan.ID, orphan.Backend)
+				} else {
+					glog.V(3).Infof("Found orphaned %s %s(%s) on backend %s: %s",
+						orphan.Kind, orphan.Name, orphan.ID, orphan.Backend, orphan.Skipped)
+				}
+			}
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (gc *GarbageCollector) loadState() error {
+	if gc.options.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(gc.options.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &gc.firstSeen); err != nil {
+		return fmt.Errorf("Invalid state file %s: %v", gc.options.StateFile, err)
+	}
+	return nil
+}
+
+func (gc *GarbageCollector) saveState() error {
+	if gc.options.StateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(gc.firstSeen)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(gc.options.StateFile, data, 0600)
+}
+
+// LiveVolumeIDsFromPersistentVolumes returns IDs of the volumes of the kubernetes PersistentVolumes
+// provisioned by the driver
+func LiveVolumeIDsFromPersistentVolumes() ([]string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeIDs []string
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == DriverName {
+			volumeIDs = append(volumeIDs, pv.Spec.CSI.VolumeHandle)
+		}
+	}
+	return volumeIDs, nil
+}
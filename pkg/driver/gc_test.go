@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+)
+
+func orphanNames(orphans []Orphan, deleted bool) []string {
+	var names []string
+	for _, orphan := range orphans {
+		if orphan.Deleted == deleted {
+			names = append(names, orphan.Kind+":"+orphan.Name)
+		}
+	}
+	return names
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+
+func TestGarbageCollector(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+
+	live := addFakeVolume(b, lunAPI, targetAPI, "pvc-live", defaultVolumeSize)
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-deleted", defaultVolumeSize)
+	// left by failed provisions
+	lunAPI.add(lunNamePrefix+"-pvc-lun", defaultLocation, defaultVolumeSize, iscsi.LunTypeBlun)
+	targetAPI.add(targetNamePrefix+"-pvc-target", iqnPrefix+"-pvc-target")
+	// still connected from a node
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-connected", defaultVolumeSize)
+	targetAPI.targets[len(targetAPI.targets)-1].ConnectedSessions = []iscsi.TargetSession{
+		{IQN: "iqn.1993-08.org.debian:01:node1", IP: "10.0.1.1"},
+	}
+	// not created by the driver
+	lunAPI.add("other-lun", defaultLocation, defaultVolumeSize, iscsi.LunTypeBlun)
+	targetAPI.add("other-target", "iqn.2000-01.com.synology:other-target")
+
+	now := time.Now()
+	gc := newGarbageCollector(backendList{b}, GCOptions{MinAge: time.Hour})
+	gc.now = func() time.Time { return now }
+
+	// orphans are not deleted until they have been found for MinAge
+	orphans, err := gc.Collect([]string{live})
+	assert.Nil(t, err)
+	assert.Empty(t, orphanNames(orphans, true))
+	assert.ElementsMatch(t, []string{
+		"target:kube-csi-pvc-deleted", "target:kube-csi-pvc-target", "target:kube-csi-pvc-connected",
+		"lun:kube-csi-pvc-deleted", "lun:kube-csi-pvc-lun", "lun:kube-csi-pvc-connected",
+	}, orphanNames(orphans, false))
+	assert.Equal(t, 0, targetAPI.calls["Delete"])
+	assert.Equal(t, 0, lunAPI.calls["Delete"])
+
+	now = now.Add(2 * time.Hour)
+	orphans, err = gc.Collect([]string{live})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"target:kube-csi-pvc-deleted", "target:kube-csi-pvc-target",
+		"lun:kube-csi-pvc-deleted", "lun:kube-csi-pvc-lun",
+	}, orphanNames(orphans, true))
+	// LUNs of connected targets are kept
+	assert.ElementsMatch(t, []string{
+		"target:kube-csi-pvc-connected", "lun:kube-csi-pvc-connected",
+	}, orphanNames(orphans, false))
+
+	var remaining []string
+	for _, lun := range lunAPI.luns {
+		remaining = append(remaining, lun.Name)
+	}
+	assert.ElementsMatch(t, []string{"kube-csi-pvc-live", "kube-csi-pvc-connected", "other-lun"}, remaining)
+	assert.Equal(t, 3, len(targetAPI.targets))
+}
+
+func TestGarbageCollectorDryRun(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-deleted", defaultVolumeSize)
+
+	gc := newGarbageCollector(backendList{b}, GCOptions{DryRun: true})
+
+	orphans, err := gc.Collect(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orphans))
+	assert.Empty(t, orphanNames(orphans, true))
+	assert.Equal(t, "dry run", orphans[0].Skipped)
+	assert.Equal(t, 1, len(lunAPI.luns))
+	assert.Equal(t, 1, len(targetAPI.targets))
+}
+
+func TestGarbageCollectorVolumeNamePrefix(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	addFakeVolume(b, lunAPI, targetAPI, "cluster1-deleted", defaultVolumeSize)
+	// volumes of another cluster sharing the NAS
+	addFakeVolume(b, lunAPI, targetAPI, "cluster2-live", defaultVolumeSize)
+	addFakeVolume(b, lunAPI, targetAPI, "cluster10-live", defaultVolumeSize)
+
+	gc := newGarbageCollector(backendList{b}, GCOptions{VolumeNamePrefix: "cluster1"})
+
+	orphans, err := gc.Collect(nil)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"target:kube-csi-cluster1-deleted", "lun:kube-csi-cluster1-deleted",
+	}, orphanNames(orphans, true))
+	assert.Empty(t, orphanNames(orphans, false))
+
+	var remaining []string
+	for _, lun := range lunAPI.luns {
+		remaining = append(remaining, lun.Name)
+	}
+	assert.ElementsMatch(t, []string{"kube-csi-cluster2-live", "kube-csi-cluster10-live"}, remaining)
+	assert.Equal(t, 2, len(targetAPI.targets))
+}
+
+func TestDriverGarbageCollector(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-deleted", defaultVolumeSize)
+
+	// the garbage collector uses the backends of the driver without logging in again
+	d := &driver{backends: backendList{b}}
+	gc := d.GarbageCollector(GCOptions{})
+
+	orphans, err := gc.Collect(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orphanNames(orphans, true)))
+	assert.Empty(t, lunAPI.luns)
+}
+
+func TestGarbageCollectorLegacyVolumeID(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-live", defaultVolumeSize)
+
+	gc := newGarbageCollector(backendList{b}, GCOptions{})
+
+	// the LUN is found from the mapping of the target
+	orphans, err := gc.Collect([]string{"1.1"})
+	assert.Nil(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestGarbageCollectorState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	b, lunAPI, targetAPI := newFakeBackend("")
+	addFakeVolume(b, lunAPI, targetAPI, "pvc-deleted", defaultVolumeSize)
+
+	now := time.Now()
+	gc := newGarbageCollector(backendList{b}, GCOptions{MinAge: time.Hour, StateFile: stateFile})
+	gc.now = func() time.Time { return now }
+
+	_, err = gc.Collect(nil)
+	assert.Nil(t, err)
+
+	// a later run finds the orphans from the state file
+	gc = newGarbageCollector(backendList{b}, GCOptions{MinAge: time.Hour, StateFile: stateFile})
+	gc.now = func() time.Time { return now.Add(2 * time.Hour) }
+	assert.Nil(t, gc.loadState())
+
+	orphans, err := gc.Collect(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orphanNames(orphans, true)))
+	assert.Empty(t, lunAPI.luns)
+	assert.Empty(t, targetAPI.targets)
+}
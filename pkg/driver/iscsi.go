@@ -19,6 +19,7 @@ package driver
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"regexp"
 	"strings"
 
@@ -29,7 +30,9 @@ import (
 )
 
 type iscsiDriver struct {
-	synologyHost string
+	// network portals of the NAS, targets are logged in on every portal
+	// to access LUNs through multiple paths
+	portals []string
 }
 
 type Session struct {
@@ -57,6 +60,40 @@ func parseSessionOutput(output string) []Session {
 	return sessions
 }
 
+// parseInitiatorName returns the initiator name in the content of /etc/iscsi/initiatorname.iscsi
+func parseInitiatorName(content string) (string, error) {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// InitiatorName=iqn.1993-08.org.debian:01:2d4b1c3c8e5f
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) == 2 && strings.TrimSpace(tokens[0]) == "InitiatorName" {
+			if name := strings.TrimSpace(tokens[1]); name != "" {
+				return name, nil
+			}
+		}
+	}
+
+	return "", errors.New("InitiatorName is not found")
+}
+
+// readInitiatorName returns the initiator name of the node from the file
+func readInitiatorName(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := parseInitiatorName(string(content))
+	if err != nil {
+		return "", fmt.Errorf("Invalid initiator name file %s: %v", path, err)
+	}
+	return name, nil
+}
+
 /************************************************************
  * iscsiDriver functions
  ************************************************************/
@@ -70,35 +107,138 @@ func iscsiadm(cmdArgs ...string) utilexec.Cmd {
 	command := "/sbin/iscsiadm " + strings.Join(cmdArgs, " ")
 	executor := utilexec.New()
 	cmd := executor.Command("sh", "-c", command)
-	glog.V(5).Infof("[EXECUTING] %s", command)
+	glog.V(5).Infof("[EXECUTING] %s", maskPasswords(cmdArgs))
 	return cmd
 }
 
+// quote the value to pass it to iscsiadm as a single argument
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'"'"'`, -1) + "'"
+}
+
+// maskPasswords returns the command line with values of password settings masked
+func maskPasswords(cmdArgs []string) string {
+	args := make([]string, len(cmdArgs))
+	copy(args, cmdArgs)
+
+	for i := 3; i < len(args); i++ {
+		// --name <name> --value <value>
+		if args[i-1] == "--value" && strings.Contains(args[i-2], "password") {
+			args[i] = "******"
+		}
+	}
+
+	return "/sbin/iscsiadm " + strings.Join(args, " ")
+}
+
+// multipath returns true if the LUNs are accessed through multiple portals
+func (d *iscsiDriver) multipath() bool {
+	return len(d.portals) > 1
+}
+
+// discovery discovers targets on the portals,
+// it succeeds if any of the portals is reachable
 func (d *iscsiDriver) discovery() error {
+	var errs []string
+	for _, portal := range d.portals {
+		cmd := iscsiadm(
+			"--mode", "discovery",
+			"--type", "sendtargets",
+			"--portal", shellQuote(portal),
+			"--discover")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			msg := fmt.Sprintf("Error running iscsiadm discovery on %s: %s(%v)", portal, out, err)
+			glog.V(3).Info(msg)
+			errs = append(errs, msg)
+		}
+	}
+
+	if len(errs) == len(d.portals) {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// updateNode updates a setting of the node record of the target on the portal
+func (d *iscsiDriver) updateNode(target *iscsi.Target, portal string, name string, value string) error {
 	cmd := iscsiadm(
-		"--mode", "discovery",
-		"--type", "sendtargets",
-		"--portal", d.synologyHost,
-		"--discover")
+		"--mode", "node",
+		"--targetname", target.IQN,
+		"--portal", shellQuote(portal),
+		"--op", "update",
+		"--name", name,
+		"--value", shellQuote(value))
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		msg := fmt.Sprintf("Error running iscsiadm discovery: %s(%v)", out, err)
+		msg := fmt.Sprintf("Error running iscsiadm update of %s: %s(%v)", name, out, err)
 		glog.V(3).Info(msg)
 		return errors.New(msg)
 	}
 	return nil
 }
 
-func (d *iscsiDriver) login(target *iscsi.Target) error {
+// setAuth configures chap authentication of the node record of the target on the portal
+func (d *iscsiDriver) setAuth(target *iscsi.Target, portal string, chap *chapCredentials) error {
+	settings := [][]string{}
+
+	switch chap.authType {
+	case iscsi.TargetAuthTypeNone:
+		settings = append(settings,
+			[]string{"node.session.auth.authmethod", "None"})
+	case iscsi.TargetAuthTypeSingleChap:
+		settings = append(settings,
+			[]string{"node.session.auth.authmethod", "CHAP"},
+			[]string{"node.session.auth.username", chap.user},
+			[]string{"node.session.auth.password", chap.password})
+	case iscsi.TargetAuthTypeMutualChap:
+		settings = append(settings,
+			[]string{"node.session.auth.authmethod", "CHAP"},
+			[]string{"node.session.auth.username", chap.user},
+			[]string{"node.session.auth.password", chap.password},
+			[]string{"node.session.auth.username_in", chap.mutualUser},
+			[]string{"node.session.auth.password_in", chap.mutualPassword})
+	}
+
+	for _, setting := range settings {
+		if err := d.updateNode(target, portal, setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// login logs in to the target on the portals,
+// it succeeds if the target is logged in on any of the portals
+func (d *iscsiDriver) login(target *iscsi.Target, chap *chapCredentials) error {
+	var errs []string
+	for _, portal := range d.portals {
+		if err := d.loginPortal(target, portal, chap); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == len(d.portals) {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (d *iscsiDriver) loginPortal(target *iscsi.Target, portal string, chap *chapCredentials) error {
+	if err := d.setAuth(target, portal, chap); err != nil {
+		return err
+	}
+
 	cmd := iscsiadm(
 		"--mode", "node",
 		"--targetname", target.IQN,
-		"--portal", d.synologyHost,
+		"--portal", shellQuote(portal),
 		"--login")
-	_, err := cmd.CombinedOutput()
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		glog.V(3).Infof("Error running iscsiadm login: %v", err)
-		return err
+		msg := fmt.Sprintf("Error running iscsiadm login on %s: %s(%v)", portal, out, err)
+		glog.V(3).Info(msg)
+		return errors.New(msg)
 	}
 	return nil
 }
@@ -113,6 +253,7 @@ func (d *iscsiDriver) session() ([]Session, error) {
 	return parseSessionOutput(string(out)), nil
 }
 
+// logout logs out from the target on all portals
 func (d *iscsiDriver) logout(target *iscsi.Target) error {
 	cmd := iscsiadm(
 		"--mode", "node",
@@ -38,4 +38,42 @@ tcp: [7] 10.0.0.1:3260,1 iqn.2000-01.com.synology:kube-csi-pvc-521ce1b7-f07c-11e
     assert.Equal(t, len(sessions), 5)
     assert.Equal(t, sessions[0].IQN, "iqn.2000-01.com.synology:kube-csi-pvc-e27d9fe3-7460-11e9-b909-74d02b7bd3f6")
     assert.Equal(t, sessions[4].IQN, "iqn.2000-01.com.synology:kube-csi-pvc-521ce1b7-f07c-11e8-ae4a-74d02b7bd3f6")
-}
\ No newline at end of file
+}
+func TestMaskPasswords(t *testing.T) {
+	command := maskPasswords([]string{
+		"--mode", "node",
+		"--op", "update",
+		"--name", "node.session.auth.password",
+		"--value", "'secret'",
+	})
+	assert.Equal(t, "/sbin/iscsiadm --mode node --op update --name node.session.auth.password --value ******", command)
+
+	command = maskPasswords([]string{
+		"--mode", "node",
+		"--op", "update",
+		"--name", "node.session.auth.username",
+		"--value", "'user'",
+	})
+	assert.Equal(t, "/sbin/iscsiadm --mode node --op update --name node.session.auth.username --value 'user'", command)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'pass word'`, shellQuote("pass word"))
+	assert.Equal(t, `'it'"'"'s'`, shellQuote("it's"))
+}
+
+func TestParseInitiatorName(t *testing.T) {
+	name, err := parseInitiatorName(`## DO NOT EDIT OR REMOVE THIS FILE!
+## If you remove this file, the iSCSI daemon will not start.
+# InitiatorName=iqn.1993-08.org.debian:01:commented
+InitiatorName=iqn.1993-08.org.debian:01:2d4b1c3c8e5f
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "iqn.1993-08.org.debian:01:2d4b1c3c8e5f", name)
+
+	_, err = parseInitiatorName("# InitiatorName=iqn.1993-08.org.debian:01:commented\n")
+	assert.NotNil(t, err)
+
+	_, err = parseInitiatorName("InitiatorName=\n")
+	assert.NotNil(t, err)
+}
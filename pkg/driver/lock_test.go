@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestKeyMutex(t *testing.T) {
+	var m keyMutex
+	counts := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+
+			defer m.lock(key)()
+			counts[key]++
+		}([]string{"vol-1", "vol-2"}[i%2])
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int{"vol-1": 50, "vol-2": 50}, counts)
+	// locks are removed once they are unlocked
+	assert.Empty(t, m.locks)
+}
@@ -19,6 +19,7 @@ package driver
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/golang/glog"
 
@@ -41,6 +42,30 @@ func isLikelyNotMountPointAttach(targetpath string) (bool, error) {
 	return notMnt, err
 }
 
+// isLikelyNotMountPointAttachFile is the same as isLikelyNotMountPointAttach,
+// but creates a file instead of a directory to bind mount a device
+func isLikelyNotMountPointAttachFile(targetpath string) (bool, error) {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(filepath.Dir(targetpath), 0750); err != nil {
+				return notMnt, err
+			}
+
+			f, err := os.OpenFile(targetpath, os.O_CREATE, 0640)
+			if err != nil {
+				return notMnt, err
+			}
+			if err = f.Close(); err != nil {
+				return notMnt, err
+			}
+
+			return true, nil
+		}
+	}
+	return notMnt, err
+}
+
 func isLikelyNotMountPointDetach(targetpath string) (bool, error) {
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetpath)
 	if err != nil {
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	sysDevBlockPath  = "/sys/dev/block"
+	multipathDevPath = "/dev/mapper"
+	// device mapper uuid of multipath devices, others are e.g. LVM- or CRYPT-
+	multipathUUIDPrefix = "mpath-"
+)
+
+// sysBlockPath is a variable to be replaced by tests
+var sysBlockPath = "/sys/block"
+
+/************************************************************
+ * helper functions
+ ************************************************************/
+
+func multipathCommand(command string, cmdArgs ...string) utilexec.Cmd {
+	// like iscsiadm, /sbin/multipath and /sbin/multipathd are shell scripts
+	// created from ConfigMap, which execute the commands on the host
+	// (see kubernetes/*/node.yml)
+	commandLine := "/sbin/" + command + " " + strings.Join(cmdArgs, " ")
+	executor := utilexec.New()
+	cmd := executor.Command("sh", "-c", commandLine)
+	glog.V(5).Infof("[EXECUTING] %s", commandLine)
+	return cmd
+}
+
+// deviceName returns the kernel name of the device, e.g. sdb or dm-0
+func deviceName(devicePath string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(realPath), nil
+}
+
+// findMultipathDevice returns the path of the multipath device(e.g. /dev/mapper/<wwid>)
+// which holds the device, or an empty string if the device is not a part of a multipath device
+func findMultipathDevice(devicePath string) string {
+	name, err := deviceName(devicePath)
+	if err != nil {
+		return ""
+	}
+
+	holders, err := ioutil.ReadDir(filepath.Join(sysBlockPath, name, "holders"))
+	if err != nil {
+		return ""
+	}
+
+	for _, holder := range holders {
+		// the device can be held by other device mapper devices, e.g. LVM
+		if !isMultipathDM(holder.Name()) {
+			continue
+		}
+
+		dmName, err := ioutil.ReadFile(filepath.Join(sysBlockPath, holder.Name(), "dm", "name"))
+		if err != nil {
+			continue
+		}
+
+		return filepath.Join(multipathDevPath, strings.TrimSpace(string(dmName)))
+	}
+
+	return ""
+}
+
+// isMultipathDevice returns true if the device is a multipath device
+func isMultipathDevice(devicePath string) bool {
+	name, err := deviceName(devicePath)
+	if err != nil {
+		return false
+	}
+	return isMultipathDM(name)
+}
+
+// isMultipathDM returns true if the kernel name(e.g. dm-0) is of a device mapper device created by multipath
+func isMultipathDM(name string) bool {
+	uuid, err := ioutil.ReadFile(filepath.Join(sysBlockPath, name, "dm", "uuid"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(uuid)), multipathUUIDPrefix)
+}
+
+// multipathSlaves returns kernel names of the devices(paths) of the multipath device
+func multipathSlaves(devicePath string) ([]string, error) {
+	name, err := deviceName(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(sysBlockPath, name, "slaves"))
+	if err != nil {
+		return nil, err
+	}
+
+	var slaves []string
+	for _, entry := range entries {
+		slaves = append(slaves, entry.Name())
+	}
+	return slaves, nil
+}
+
+// flushMultipathDevice removes the multipath map of the device
+func flushMultipathDevice(devicePath string) error {
+	cmd := multipathCommand("multipath", "-f", shellQuote(devicePath))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := fmt.Sprintf("Error flushing multipath device %s: %s(%v)", devicePath, out, err)
+		glog.V(3).Info(msg)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// resizeMultipathDevice updates the size of the multipath map
+// after the devices of the paths are rescanned
+func resizeMultipathDevice(devicePath string) error {
+	name := filepath.Base(devicePath)
+	if !strings.HasPrefix(devicePath, multipathDevPath+"/") {
+		// /dev/dm-N, find the name of the map
+		dmName, err := ioutil.ReadFile(filepath.Join(sysBlockPath, name, "dm", "name"))
+		if err != nil {
+			return err
+		}
+		name = strings.TrimSpace(string(dmName))
+	}
+
+	cmd := multipathCommand("multipathd", "resize", "map", shellQuote(name))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := fmt.Sprintf("Error resizing multipath map %s: %s(%v)", name, out, err)
+		glog.V(3).Info(msg)
+		return errors.New(msg)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFile creates the file and its parent directories
+func writeFile(t *testing.T, path string, content string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestMultipathDevice(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "synology-csi")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origSysBlockPath := sysBlockPath
+	sysBlockPath = filepath.Join(tmpDir, "sys", "block")
+	defer func() { sysBlockPath = origSysBlockPath }()
+
+	devPath := filepath.Join(tmpDir, "dev")
+	for _, name := range []string{"sdb", "sdc", "sdd", "dm-0", "dm-1"} {
+		writeFile(t, filepath.Join(devPath, name), "")
+	}
+
+	// sdb and sdc are paths of dm-0, and sdd holds an LVM volume dm-1
+	writeFile(t, filepath.Join(sysBlockPath, "dm-0", "dm", "uuid"), "mpath-36001405a1b2c3d4e5f6\n")
+	writeFile(t, filepath.Join(sysBlockPath, "dm-0", "dm", "name"), "36001405a1b2c3d4e5f6\n")
+	writeFile(t, filepath.Join(sysBlockPath, "dm-1", "dm", "uuid"), "LVM-Q1w2E3r4T5y6\n")
+	writeFile(t, filepath.Join(sysBlockPath, "dm-1", "dm", "name"), "vg0-lv0\n")
+	writeFile(t, filepath.Join(sysBlockPath, "sdb", "holders", "dm-0"), "")
+	writeFile(t, filepath.Join(sysBlockPath, "sdc", "holders", "dm-0"), "")
+	writeFile(t, filepath.Join(sysBlockPath, "sdd", "holders", "dm-1"), "")
+
+	assert.True(t, isMultipathDevice(filepath.Join(devPath, "dm-0")))
+	assert.False(t, isMultipathDevice(filepath.Join(devPath, "dm-1")))
+	assert.False(t, isMultipathDevice(filepath.Join(devPath, "sdb")))
+	assert.False(t, isMultipathDevice(filepath.Join(devPath, "sde")))
+
+	assert.Equal(t, "/dev/mapper/36001405a1b2c3d4e5f6", findMultipathDevice(filepath.Join(devPath, "sdb")))
+	assert.Equal(t, "/dev/mapper/36001405a1b2c3d4e5f6", findMultipathDevice(filepath.Join(devPath, "sdc")))
+	assert.Equal(t, "", findMultipathDevice(filepath.Join(devPath, "sdd")))
+}
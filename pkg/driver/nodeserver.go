@@ -17,10 +17,12 @@
 package driver
 
 import (
-	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"io/ioutil"
@@ -33,6 +35,7 @@ import (
 	"golang.org/x/net/context"
 
 	"k8s.io/kubernetes/pkg/util/resizefs"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
 	"k8s.io/utils/exec"
 	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/mount"
@@ -46,244 +49,466 @@ import (
 const (
 	probeDeviceInterval = 1 * time.Second
 	probeDeviceTimeout  = 60 * time.Second
+	// how long to wait for the multipath device after a device of the LUN is found
+	probeMultipathTimeout = 10 * time.Second
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
 
-	targetAPI iscsi.TargetAPI
-	lunAPI    iscsi.LunAPI
+	backends backendList
 
-	iscsiDrv iscsiDriver
+	// topology segments of the node
+	topology map[string]string
+	// file containing the initiator name of the node
+	initiatorNameFile string
+	// directory keeping the targets of staged volumes
+	stagedVolumeDir string
 }
 
-func getDevicePath(targetDevPath string) string {
+// getDevicePaths returns devices of the LUN, one for each portal the target is logged in
+func getDevicePaths(targetDevPath string) []string {
 	diskDevPath := "/dev/disk/by-path"
 
+	var paths []string
 	if entries, err := ioutil.ReadDir(diskDevPath); err == nil {
 		for _, f := range entries {
 			// example:
 			//    ip-192.168.1.196:3260-iscsi-iqn.2000-01.com.synology:JPNAS02.Target-23.cf8d920aa9-lun-1
 			glog.V(5).Info(f.Name())
-			if strings.Index(f.Name(), targetDevPath) != -1 {
-				return strings.Join([]string{diskDevPath, f.Name()}, "/")
+			if strings.HasSuffix(f.Name(), targetDevPath) {
+				paths = append(paths, strings.Join([]string{diskDevPath, f.Name()}, "/"))
 			}
 		}
 	}
 
-	return ""
+	return paths
+}
+
+// getDevicePath returns the device of the LUN,
+// which is the multipath device if the devices of the LUN are assembled by dm-multipath
+func getDevicePath(targetDevPath string) string {
+	paths := getDevicePaths(targetDevPath)
+	if len(paths) == 0 {
+		return ""
+	}
+
+	for _, path := range paths {
+		if multipathDevice := findMultipathDevice(path); multipathDevice != "" {
+			return multipathDevice
+		}
+	}
+
+	return paths[0]
 }
 
-func probeDevice(targetDevPath string) (string, error) {
+// probeDevice waits for the device of the LUN.
+// If multipath is true, it waits until the devices are assembled into a multipath device,
+// and falls back to the device of a single path if no multipath device shows up,
+// e.g. the target is logged in on only one of the portals.
+func probeDevice(targetDevPath string, multipath bool) (string, error) {
 	ticker := time.NewTicker(probeDeviceInterval)
 	defer ticker.Stop()
 	timer := time.NewTimer(probeDeviceTimeout)
 	defer timer.Stop()
 
+	var foundAt time.Time
 	for {
 		select {
 		case <-ticker.C:
-			if devicePath := getDevicePath(targetDevPath); devicePath != "" {
+			devicePath := getDevicePath(targetDevPath)
+			if devicePath == "" {
+				continue
+			}
+			if !multipath || isMultipathDevice(devicePath) {
+				return devicePath, nil
+			}
+
+			if foundAt.IsZero() {
+				foundAt = time.Now()
+			}
+			if time.Since(foundAt) >= probeMultipathTimeout {
+				glog.Warningf(
+					"No multipath device for %s, using %s. Check if multipathd is running", targetDevPath, devicePath)
 				return devicePath, nil
 			}
+			glog.V(5).Infof("Waiting for multipath device of %s", devicePath)
 		case <-timer.C:
 			return "", fmt.Errorf("Timed out while waiting for device for %s", targetDevPath)
-
 		}
 	}
 }
 
-// NodePublishVolume mounts the volume to target path
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// publishBlockVolume bind mounts the device to the target path
+func publishBlockVolume(devicePath string, targetPath string, readOnly bool) error {
+	notMnt, err := isLikelyNotMountPointAttachFile(targetPath)
+	if err != nil {
+		return err
+	}
+
+	if !notMnt {
+		glog.V(5).Infof("%s is already mounted", targetPath)
+		return nil
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	glog.V(5).Infof("Mounting %s to %s(options: %v)", devicePath, targetPath, options)
+	return mount.New("").Mount(devicePath, targetPath, "", options)
+}
+
+// getTarget returns the backend, the target and the mapping index of the LUN for the volume ID
+func (ns *nodeServer) getTarget(volID string) (*backend, *iscsi.Target, int, error) {
+	b, target, id, err := ns.backends.findTarget(volID)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return b, target, id.mappingIndex, nil
+}
+
+// getStagedVolume returns the target the volume is staged from.
+// The target is queried from the NAS if the volume is staged by an older version of the driver.
+func (ns *nodeServer) getStagedVolume(volID string) (*stagedVolume, error) {
+	staged, err := loadStagedVolume(ns.stagedVolumeDir, volID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to load the target of volume %s: %v", volID, err)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if staged != nil {
+		return staged, nil
+	}
+
+	b, target, mappingIndex, err := ns.getTarget(volID)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedVolume{IQN: target.IQN, MappingIndex: mappingIndex, Portals: b.iscsiDrv.portals}, nil
+}
+
+// NodeStageVolume logs in to the target of the volume,
+// and mounts the device to the staging path shared by the pods on the node
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volID := req.GetVolumeId()
-	targetPath := req.GetTargetPath()
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
-	// TODO: support chap
-	// secrets := req.GetNodePublishSecrets()
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path is required")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
+	}
 
-	targetID, mappingIndex, err := parseVolumeID(volID)
+	chap, err := parseChapSecrets(req.GetSecrets())
 	if err != nil {
+		glog.V(3).Infof("Invalid chap secrets: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	target, err := ns.targetAPI.Get(targetID)
+	b, target, mappingIndex, err := ns.getTarget(volID)
 	if err != nil {
-		msg := fmt.Sprintf(
-			"Unable to find target of ID: %d", targetID)
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.NotFound, msg)
+		return nil, err
 	}
 
 	// run discovery to add target
-	if err = ns.iscsiDrv.discovery(); err != nil {
+	if err = b.iscsiDrv.discovery(); err != nil {
 		msg := fmt.Sprintf("Failed to run ISCSI discovery: %v", err)
 		glog.V(3).Info(msg)
 		return nil, status.Error(codes.Internal, msg)
 	}
 
-	hasSession, err := ns.hasSession(target.IQN)
+	hasSession, err := ns.hasSession(&b.iscsiDrv, target.IQN)
 	if err != nil {
 		return nil, err
 	}
 
+	succeeded := false
 	if hasSession {
 		glog.V(5).Infof("Found an existing session for %s", target.IQN)
 	} else {
 		// login
-		if err = ns.iscsiDrv.login(target); err != nil {
+		if err = b.iscsiDrv.login(target, chap); err != nil {
 			msg := fmt.Sprintf("Failed to run ISCSI login: %v", err)
 			glog.V(3).Info(msg)
 			return nil, status.Error(codes.Internal, msg)
 		}
 
 		defer func() {
-			// logout target when we fail to mount
-			if err != nil {
-				_ = ns.iscsiDrv.logout(target)
+			// logout target when we fail to stage
+			if !succeeded {
+				_ = b.iscsiDrv.logout(target)
 			}
 		}()
 	}
 
 	// find device mapped to the target
-	targetDevPath := fmt.Sprintf("%s-lun-%d", target.IQN, mappingIndex)
+	staged := &stagedVolume{IQN: target.IQN, MappingIndex: mappingIndex, Portals: b.iscsiDrv.portals}
+	targetDevPath := staged.targetDevPath()
 
-	devicePath, err := probeDevice(targetDevPath)
+	devicePath, err := probeDevice(targetDevPath, b.iscsiDrv.multipath())
 	if err != nil {
-		msg := fmt.Sprintf("Failed to find device for %s", targetDevPath)
+		msg := fmt.Sprintf("Failed to find device for %s: %v", targetDevPath, err)
 		glog.V(3).Info(msg)
-		return nil, errors.New(msg)
+		return nil, status.Error(codes.Internal, msg)
 	}
 
-	glog.V(5).Infof("Target path: %s", targetPath)
+	// the volume is unstaged with the target, even if the NAS is not reachable
+	if err = saveStagedVolume(ns.stagedVolumeDir, volID, staged); err != nil {
+		msg := fmt.Sprintf("Failed to save the target of volume %s: %v", volID, err)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
 
-	notMnt, err := isLikelyNotMountPointAttach(targetPath)
+	if volCap.GetBlock() != nil {
+		// block volumes are published from the device directly
+		succeeded = true
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	glog.V(5).Infof("Staging path: %s", stagingPath)
+
+	notMnt, err := isLikelyNotMountPointAttach(stagingPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	// notMnt := true
 
-	if notMnt {
-		exists, err := mount.PathExists(devicePath)
-		if !exists || err != nil {
-			msg := fmt.Sprintf("Could not find ISCSI device: %s", devicePath)
-			glog.V(3).Info(msg)
-			return nil, status.Error(codes.Internal, msg)
-		}
+	if !notMnt {
+		glog.V(5).Infof("%s is already mounted", stagingPath)
+		succeeded = true
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// mount device to the staging path
+	mounter := &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      utilexec.New(),
+	}
 
-		targetExists, err := mount.PathExists(targetPath)
+	fsType := volCap.GetMount().GetFsType()
+	readOnly := isReadOnlyMode(volCap.GetAccessMode().GetMode())
+	if readOnly && fsType == "" {
+		// read-only volumes are populated from a source, mount the file system of the source
+		format, err := mounter.GetDiskFormat(devicePath)
 		if err != nil {
-			msg := fmt.Sprintf("Corrupted mount point: %s", targetPath)
+			msg := fmt.Sprintf("Failed to get the file system of %s: %v", devicePath, err)
 			glog.V(3).Info(msg)
 			return nil, status.Error(codes.Internal, msg)
-		} else if !targetExists {
-			msg := fmt.Sprintf("Mount point does not exist: %s", targetPath)
+		}
+		fsType = format
+	}
+	options := stageMountOptions(fsType, readOnly, volCap.GetMount().GetMountFlags())
+
+	glog.V(5).Infof(
+		"Mounting %s to %s(fstype: %s, options: %v)",
+		devicePath, stagingPath, fsType, options)
+	err = mounter.FormatAndMount(devicePath, stagingPath, fsType, options)
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to mount %s to %s(fstype: %s, options: %v): %v",
+			devicePath, stagingPath, fsType, options, err)
+		glog.V(5).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+
+	// TODO(jpark):
+	// change owner of the root path:
+	// https://github.com/kubernetes/kubernetes/pull/62486
+	//	 https://github.com/kubernetes/kubernetes/pull/62486/files
+	// https://github.com/kubernetes/kubernetes/issues/66323
+	//	https://github.com/kubernetes/kubernetes/pull/67280/files
+
+	glog.V(5).Infof(
+		"Mounted %s to %s(fstype: %s, options: %v)",
+		devicePath, stagingPath, fsType, options)
+
+	succeeded = true
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// stageMountOptions returns the options to mount the file system of a volume to the staging path
+func stageMountOptions(fsType string, readOnly bool, mountFlags []string) []string {
+	if !readOnly {
+		return append([]string{"rw"}, mountFlags...)
+	}
+
+	// the target only allows reading, so that the journal of a file system
+	// from a snapshot of a mounted volume can not be replayed
+	options := []string{"ro"}
+	switch fsType {
+	case "", "ext3", "ext4":
+		// ext4 is the default file system of the mounter
+		options = append(options, "noload")
+	case "xfs":
+		options = append(options, "norecovery")
+	}
+	return append(options, mountFlags...)
+}
+
+// NodeUnstageVolume unmounts the staging path and logs out from the target.
+// The target is found from what is saved when the volume is staged, not to query the NAS.
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path is required")
+	}
+
+	mounter := mount.New("")
+	notMnt, err := mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		msg := fmt.Sprintf("Failed to check mount point %s: %v", stagingPath, err)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+
+	if err == nil && !notMnt {
+		if err = mounter.Unmount(stagingPath); err != nil {
+			msg := fmt.Sprintf("Failed to unmount %s: %v", stagingPath, err)
 			glog.V(3).Info(msg)
 			return nil, status.Error(codes.Internal, msg)
 		}
+	}
 
-		// mount device to the target path
-		mounter := &mount.SafeFormatAndMount{
-			Interface: mount.New(""),
-			Exec:      utilexec.New(),
+	staged, err := ns.getStagedVolume(volID)
+	if status.Code(err) == codes.NotFound {
+		glog.V(3).Infof("Target of volume %s is not found, assume it is logged out: %v", volID, err)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// remove the multipath map before the paths are gone
+	if devicePath := getDevicePath(staged.targetDevPath()); devicePath != "" && isMultipathDevice(devicePath) {
+		if err = flushMultipathDevice(devicePath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
+	}
 
-		options := []string{"rw"}
-		mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-		options = append(options, mountFlags...)
+	iscsiDrv := &iscsiDriver{portals: staged.Portals}
+	hasSession, err := ns.hasSession(iscsiDrv, staged.IQN)
+	if err != nil {
+		return nil, err
+	}
 
-		glog.V(5).Infof(
-			"Mounting %s to %s(fstype: %s, options: %v)",
-			devicePath, targetPath, fsType, options)
-		err = mounter.FormatAndMount(devicePath, targetPath, fsType, options)
-		if err != nil {
+	// logout target
+	// NOTE: we can safely log out because pods on the node share the staging path
+	//	and we only support targets with a single lun
+	if hasSession {
+		if err = iscsiDrv.logout(&iscsi.Target{IQN: staged.IQN}); err != nil {
 			msg := fmt.Sprintf(
-				"Failed to mount %s to %s(fstype: %s, options: %v): %v",
-				devicePath, targetPath, fsType, options, err)
-			glog.V(5).Info(msg)
+				"Failed to logout(iqn: %s): %v", staged.IQN, err)
+			glog.V(3).Info(msg)
 			return nil, status.Error(codes.Internal, msg)
 		}
+	}
 
-		// TODO(jpark):
-		// change owner of the root path:
-		// https://github.com/kubernetes/kubernetes/pull/62486
-		//	 https://github.com/kubernetes/kubernetes/pull/62486/files
-		// https://github.com/kubernetes/kubernetes/issues/66323
-		//	https://github.com/kubernetes/kubernetes/pull/67280/files
-
-		glog.V(5).Infof(
-			"Mounted %s to %s(fstype: %s, options: %v)",
-			devicePath, targetPath, fsType, options)
-	} else {
-		glog.V(5).Infof("%s is already mounted", targetPath)
+	if err = removeStagedVolume(ns.stagedVolumeDir, volID); err != nil {
+		msg := fmt.Sprintf("Failed to remove the target of volume %s: %v", volID, err)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
 	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+// NodePublishVolume bind mounts the staged volume to target path
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
 
-	targetID, _, err := parseVolumeID(volID)
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path is required")
 	}
 
-	target, err := ns.targetAPI.Get(targetID)
-	if err != nil {
-		msg := fmt.Sprintf(
-			"Unable to find target of ID: %d", targetID)
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.NotFound, msg)
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
 	}
 
-	/*
-		notMnt, err := isLikelyNotMountPointDetach(targetPath)
+	glog.V(5).Infof("Target path: %s", targetPath)
+
+	readOnly := req.GetReadonly() || isReadOnlyMode(volCap.GetAccessMode().GetMode())
+
+	if volCap.GetBlock() != nil {
+		staged, err := ns.getStagedVolume(volID)
 		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, err
 		}
-	*/
-	notMnt := false
 
-	if notMnt {
-		msg := fmt.Sprintf("Path %s not mounted", targetPath)
-		glog.V(3).Info(msg)
-		return nil, status.Errorf(codes.NotFound, msg)
+		// find device mapped to the target, which is attached in NodeStageVolume
+		targetDevPath := staged.targetDevPath()
+		devicePath := getDevicePath(targetDevPath)
+		if devicePath == "" {
+			msg := fmt.Sprintf("Unable to find device for %s, volume is not staged", targetDevPath)
+			glog.V(3).Info(msg)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+
+		// raw block volume, expose the device file at the target path
+		if err = publishBlockVolume(devicePath, targetPath, readOnly); err != nil {
+			msg := fmt.Sprintf(
+				"Failed to publish block device %s to %s: %v", devicePath, targetPath, err)
+			glog.V(3).Info(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	mounter := &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      utilexec.New(),
+	notMnt, err := isLikelyNotMountPointAttach(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if err = mounter.Unmount(targetPath); err != nil {
-		msg := fmt.Sprintf("Failed to unmount %s: %v", targetPath, err)
-		glog.V(3).Info(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+	if !notMnt {
+		glog.V(5).Infof("%s is already mounted", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	// logout target
-	// NOTE: we can safely log out because we do not share the target
-	//	and we only support targets with a single lun
-	if err = ns.iscsiDrv.logout(target); err != nil {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	options = append(options, volCap.GetMount().GetMountFlags()...)
+
+	glog.V(5).Infof(
+		"Mounting %s to %s(options: %v)", stagingPath, targetPath, options)
+	if err = mount.New("").Mount(stagingPath, targetPath, "", options); err != nil {
 		msg := fmt.Sprintf(
-			"Failed to logout(iqn: %s): %v", target.IQN, err)
+			"Failed to mount %s to %s(options: %v): %v",
+			stagingPath, targetPath, options, err)
 		glog.V(3).Info(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(codes.Internal, msg)
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-// NodeStageVolume temporarily mounts the volume to a staging path
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	// No staging is necessary since we do not share volumes
-	return &csi.NodeStageVolumeResponse{}, nil
-}
+// NodeUnpublishVolume unmounts the volume from the target path
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	// No staging is necessary since we do not share volumes
-	return &csi.NodeUnstageVolumeResponse{}, nil
+	// unmount and remove the target path,
+	// which is a file for block volumes and a directory for the others
+	if err := mount.CleanupMountPoint(targetPath, mount.New(""), true); err != nil {
+		msg := fmt.Sprintf("Failed to unmount %s: %v", targetPath, err)
+		glog.V(3).Info(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -301,45 +526,48 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return nil, status.Error(codes.FailedPrecondition, msg)
 	}
 
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
-	if fsType == "" {
-		msg := fmt.Sprintf("Cannot detect filesystem type")
-		glog.V(3).Info(msg)
-		return nil, status.Error(codes.FailedPrecondition, msg)
-	}
-
 	mounter := &mount.SafeFormatAndMount{
 		Interface: mount.New(""),
 		Exec:      utilexec.New(),
 	}
 
-	// ex) devicePath = /dev/sdX
-	args := []string{"-o", "source", "--noheadings", "--target", volumePath}
-	output, err := mounter.Exec.Command("findmnt", args...).CombinedOutput()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Cannot detect device path for volume %s: %v", volumePath, err)
-	}
-	devicePath := strings.TrimSpace(string(output))
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
 
-	// ex) /sys/block/sdX/device/rescan is rescan device path
-	blockDeviceRescanPath := ""
-	parts := strings.Split(devicePath, "/")
-	if len(parts) == 3 && strings.HasPrefix(parts[1], "dev") {
-		d := filepath.Join("/sys/block", parts[2], "device", "rescan")
-		blockDeviceRescanPath, err = filepath.EvalSymlinks(d)
+	var devicePath string
+	if isBlock {
+		// the device is bind mounted to the volume path
+		name, err := blockDeviceName(volumePath)
 		if err != nil {
-			return nil, status.Error(codes.Internal, "")
+			return nil, status.Errorf(codes.Internal, "Cannot detect device of block volume %s: %v", volumePath, err)
 		}
+		devicePath = filepath.Join("/dev", name)
 	} else {
-		msg := fmt.Sprintf("device path %s is invalid format", devicePath)
-		return nil, status.Error(codes.Internal, msg)
+		fsType := req.GetVolumeCapability().GetMount().GetFsType()
+		if fsType == "" {
+			msg := fmt.Sprintf("Cannot detect filesystem type")
+			glog.V(3).Info(msg)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+
+		// ex) devicePath = /dev/sdX
+		args := []string{"-o", "source", "--noheadings", "--target", volumePath}
+		output, err := mounter.Exec.Command("findmnt", args...).CombinedOutput()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot detect device path for volume %s: %v", volumePath, err)
+		}
+		devicePath = strings.TrimSpace(string(output))
 	}
-	// write data for triggering to rescan
-	err = ioutil.WriteFile(blockDeviceRescanPath, []byte{'1'}, 0666)
-	if err != nil {
+
+	if err := rescanDevice(devicePath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if isBlock {
+		// no file system to resize on raw block volumes
+		glog.V(5).Infof("Volume %s is a block volume, skip resizing file system", volID)
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
 	// resize file system
 	r := resizefs.NewResizeFs(mounter)
 	if _, err := r.Resize(devicePath, volumePath); err != nil {
@@ -349,10 +577,178 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
+// rescanDevice makes the kernel read the new size of the device of the LUN.
+// For multipath devices(e.g. /dev/mapper/<wwid>), devices of all paths are rescanned, and the map is resized.
+func rescanDevice(devicePath string) error {
+	if !isMultipathDevice(devicePath) {
+		name, err := deviceName(devicePath)
+		if err != nil {
+			return fmt.Errorf("Cannot find device %s: %v", devicePath, err)
+		}
+		return rescanBlockDevice(name)
+	}
+
+	slaves, err := multipathSlaves(devicePath)
+	if err != nil {
+		return fmt.Errorf("Cannot find paths of multipath device %s: %v", devicePath, err)
+	}
+	for _, slave := range slaves {
+		if err = rescanBlockDevice(slave); err != nil {
+			return err
+		}
+	}
+	return resizeMultipathDevice(devicePath)
+}
+
+// blockDeviceName returns the kernel name of the device file at the path, e.g. sdX or dm-N
+func blockDeviceName(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 {
+		return "", fmt.Errorf("%s is not a device file", path)
+	}
+
+	// /sys/dev/block/<major>:<minor> links to the device
+	major, minor := splitDeviceNumber(uint64(stat.Rdev))
+	realPath, err := filepath.EvalSymlinks(filepath.Join(sysDevBlockPath, fmt.Sprintf("%d:%d", major, minor)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(realPath), nil
+}
+
+// splitDeviceNumber returns the major and the minor numbers of the device number encoded by the kernel
+func splitDeviceNumber(dev uint64) (uint64, uint64) {
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	return major, minor
+}
+
+// rescanBlockDevice makes the kernel read the new size of the device, e.g. sdX
+func rescanBlockDevice(name string) error {
+	// ex) /sys/block/sdX/device/rescan is rescan device path
+	d := filepath.Join(sysBlockPath, name, "device", "rescan")
+	blockDeviceRescanPath, err := filepath.EvalSymlinks(d)
+	if err != nil {
+		return err
+	}
+
+	// write data for triggering to rescan
+	return ioutil.WriteFile(blockDeviceRescanPath, []byte{'1'}, 0666)
+}
+
+// NodeGetVolumeStats returns usage and condition of the volume published to the path
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volID := req.GetVolumeId()
+	if volID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path is required")
+	}
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %s does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to stat %s: %v", volumePath, err)
+	}
+
+	isBlock := info.Mode()&os.ModeDevice != 0
+
+	var usage []*csi.VolumeUsage
+	if isBlock {
+		// ex) blockdev --getsize64 /var/lib/kubelet/.../<volume id>
+		output, err := utilexec.New().Command("blockdev", "--getsize64", volumePath).CombinedOutput()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to get size of block device %s: %s(%v)", volumePath, output, err)
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Invalid size of block device %s: %s", volumePath, output)
+		}
+
+		usage = []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: size,
+			},
+		}
+	} else {
+		available, capacity, used, inodes, inodesFree, inodesUsed, err := fs.FsInfo(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to get file system stats of %s: %v", volumePath, err)
+		}
+
+		usage = []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Available: available,
+				Total:     capacity,
+				Used:      used,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Available: inodesFree,
+				Total:     inodes,
+				Used:      inodesUsed,
+			},
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: ns.volumeCondition(volID, volumePath, isBlock),
+	}, nil
+}
+
+// volumeCondition checks the mount point and the iscsi session of the volume
+func (ns *nodeServer) volumeCondition(volID string, volumePath string, isBlock bool) *csi.VolumeCondition {
+	if !isBlock {
+		notMnt, err := mount.New("").IsLikelyNotMountPoint(volumePath)
+		if err != nil || notMnt {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("Volume path %s is not mounted", volumePath),
+			}
+		}
+	}
+
+	// the target is found on the node, so that the NAS being unreachable does not make volumes abnormal
+	staged, err := ns.getStagedVolume(volID)
+	if err != nil {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Unable to find target of the volume: %v", err),
+		}
+	}
+
+	hasSession, err := ns.hasSession(&iscsiDriver{portals: staged.Portals}, staged.IQN)
+	if err != nil || !hasSession {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("No ISCSI session for %s", staged.IQN),
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "Volume is healthy",
+	}
+}
+
 // Check if session exists for the given IQN
-func (ns *nodeServer) hasSession(iqn string) (bool, error) {
+func (ns *nodeServer) hasSession(d *iscsiDriver, iqn string) (bool, error) {
 	// check if we already have a session
-	sessions, err := ns.iscsiDrv.session()
+	sessions, err := d.session()
 	if err != nil {
 		if exiterr, ok := err.(exec.ExitError); ok {
 			if exiterr.ExitStatus() == 21 {
@@ -375,9 +771,37 @@ func (ns *nodeServer) hasSession(iqn string) (bool, error) {
 	return false, nil
 }
 
+// NodeGetInfo returns the initiator name of the node as the node ID, and the topology of the node.
+// Controller uses the initiator name to allow the node to access targets of published volumes.
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	initiatorName, err := readInitiatorName(ns.initiatorNameFile)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to read initiator name of node %s: %v", resp.NodeId, err)
+		glog.V(3).Info(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	resp.NodeId = initiatorName
+
+	if len(ns.topology) > 0 {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: ns.topology,
+		}
+	}
+
+	return resp, nil
+}
+
 func (ns *nodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	capabilities := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	}
 
 	caps := make([]*csi.NodeServiceCapability, len(capabilities))
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestSplitDeviceNumber(t *testing.T) {
+	testCases := []struct {
+		dev   uint64
+		major uint64
+		minor uint64
+	}{
+		{0x810, 8, 16},     // sdb
+		{0x10300, 259, 0},  // nvme0n1
+		{0x10082c, 8, 300}, // minor numbers above 255
+		{0xfd00, 253, 0},   // dm-0
+	}
+
+	for _, tc := range testCases {
+		major, minor := splitDeviceNumber(tc.dev)
+		assert.Equal(t, tc.major, major, "%x", tc.dev)
+		assert.Equal(t, tc.minor, minor, "%x", tc.dev)
+	}
+}
+
+func TestStageMountOptions(t *testing.T) {
+	testCases := []struct {
+		fsType     string
+		readOnly   bool
+		mountFlags []string
+		expected   []string
+	}{
+		{"ext4", false, nil, []string{"rw"}},
+		{"xfs", false, []string{"noatime"}, []string{"rw", "noatime"}},
+
+		// journals are not replayed on read-only volumes
+		{"", true, nil, []string{"ro", "noload"}},
+		{"ext4", true, []string{"noatime"}, []string{"ro", "noload", "noatime"}},
+		{"ext3", true, nil, []string{"ro", "noload"}},
+		{"xfs", true, nil, []string{"ro", "norecovery"}},
+		{"btrfs", true, nil, []string{"ro"}},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, stageMountOptions(tc.fsType, tc.readOnly, tc.mountFlags), tc)
+	}
+}
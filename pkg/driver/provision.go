@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"github.com/golang/glog"
+)
+
+// provisionStep is a completed step of provisioning a volume
+type provisionStep struct {
+	description string
+	undo        func() error
+}
+
+// provisionWorkflow records the steps completed while provisioning a volume,
+// so that the objects created on the NAS can be removed if a later step fails
+type provisionWorkflow struct {
+	volName string
+	steps   []provisionStep
+}
+
+func newProvisionWorkflow(volName string) *provisionWorkflow {
+	return &provisionWorkflow{volName: volName}
+}
+
+// done records the completed step with the function to undo it
+func (w *provisionWorkflow) done(description string, undo func() error) {
+	glog.V(5).Infof("Provisioning %s: %s", w.volName, description)
+	w.steps = append(w.steps, provisionStep{description: description, undo: undo})
+}
+
+// rollback undoes the completed steps in the reverse order.
+// It continues on errors to remove as many objects as possible, and returns the first error.
+func (w *provisionWorkflow) rollback() error {
+	var firstErr error
+	for i := len(w.steps) - 1; i >= 0; i-- {
+		step := w.steps[i]
+		glog.V(3).Infof("Rolling back provisioning %s: %s", w.volName, step.description)
+
+		if err := step.undo(); err != nil {
+			glog.Errorf("Failed to roll back provisioning %s(%s): %v", w.volName, step.description, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	w.steps = nil
+
+	return firstErr
+}
+
+// commit forgets the completed steps once the volume is provisioned
+func (w *provisionWorkflow) commit() {
+	w.steps = nil
+}
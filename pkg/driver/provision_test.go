@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+
+func TestProvisionWorkflow(t *testing.T) {
+	var undone []string
+	undo := func(name string, err error) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return err
+		}
+	}
+
+	// steps are undone in the reverse order, even if some of them fail
+	wf := newProvisionWorkflow("pvc-1")
+	wf.done("step 1", undo("step 1", nil))
+	wf.done("step 2", undo("step 2", errors.New("step 2 failed")))
+	wf.done("step 3", undo("step 3", errors.New("step 3 failed")))
+
+	err := wf.rollback()
+	assert.EqualError(t, err, "step 3 failed")
+	assert.Equal(t, []string{"step 3", "step 2", "step 1"}, undone)
+
+	// nothing is undone after commit
+	undone = nil
+	wf = newProvisionWorkflow("pvc-2")
+	wf.done("step 1", undo("step 1", nil))
+	wf.commit()
+
+	assert.Nil(t, wf.rollback())
+	assert.Empty(t, undone)
+}
+
+func TestCreateVolumeRollback(t *testing.T) {
+	newRequest := func(name string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: defaultVolumeSize},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+		}
+	}
+
+	testCases := []struct {
+		failedMethod string
+		// calls made to undo the completed steps
+		lunDeletes    int
+		targetDeletes int
+		unmaps        int
+	}{
+		{"Create", 1, 0, 0},
+		{"SetACLs", 1, 1, 0},
+		{"MapLun", 1, 1, 0},
+		{"Get", 1, 1, 1},
+	}
+
+	for _, tc := range testCases {
+		b, lunAPI, targetAPI := newFakeBackend("")
+		cs := newTestControllerServer(backendList{b})
+		targetAPI.errs[tc.failedMethod] = errors.New("DSM error")
+
+		_, err := cs.CreateVolume(context.Background(), newRequest("pvc-1"))
+		assert.Equal(t, codes.Internal, status.Code(err), tc.failedMethod)
+
+		// nothing is left on the NAS
+		assert.Empty(t, lunAPI.luns, tc.failedMethod)
+		assert.Empty(t, targetAPI.targets, tc.failedMethod)
+		assert.Equal(t, tc.lunDeletes, lunAPI.calls["Delete"], tc.failedMethod)
+		assert.Equal(t, tc.targetDeletes, targetAPI.calls["Delete"], tc.failedMethod)
+		assert.Equal(t, tc.unmaps, targetAPI.calls["UnmapLun"], tc.failedMethod)
+	}
+}
+
+func TestCreateVolumeRollbackRepair(t *testing.T) {
+	b, lunAPI, targetAPI := newFakeBackend("")
+	cs := newTestControllerServer(backendList{b})
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: defaultVolumeSize},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+	}
+
+	// objects left by a previous request are not removed
+	lun := lunAPI.add(lunNamePrefix+"-pvc-1", defaultLocation, defaultVolumeSize, "")
+	target := targetAPI.add(targetNamePrefix+"-pvc-1", iqnPrefix+"-pvc-1")
+	targetAPI.errs["Get"] = errors.New("DSM error")
+
+	_, err := cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, 0, lunAPI.calls["Delete"])
+	assert.Equal(t, 0, targetAPI.calls["Delete"])
+	assert.Equal(t, 1, targetAPI.calls["UnmapLun"])
+	assert.False(t, lun.IsMapped)
+	assert.Empty(t, target.MappedLuns)
+
+	// the next request completes the volume
+	delete(targetAPI.errs, "Get")
+	resp, err := cs.CreateVolume(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, makeVolumeID("", target.TargetID, 1, lun.UUID), resp.GetVolume().GetVolumeId())
+
+	// a LUN created for a target mapped to another LUN is removed
+	other := lunAPI.add("other-lun", defaultLocation, defaultVolumeSize, "")
+	targetAPI.mapLun(targetAPI.add(targetNamePrefix+"-pvc-2", iqnPrefix+"-pvc-2"), other.UUID)
+
+	req.Name = "pvc-2"
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Nil(t, lunAPI.find(lunNamePrefix+"-pvc-2"))
+}
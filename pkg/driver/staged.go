@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// defaultStagedVolumeDir is the directory on the node keeping the targets of staged volumes,
+// which is in the plugin directory of the driver on the host
+const defaultStagedVolumeDir = "/var/lib/kubelet/plugins/" + DriverName + "/staged"
+
+// stagedVolume is the target a volume is staged from.
+// It is saved when the volume is staged, so that the volume can be unstaged
+// without querying the NAS, which may be unreachable or have deleted the target.
+type stagedVolume struct {
+	IQN          string   `json:"iqn"`
+	MappingIndex int      `json:"mappingIndex"`
+	Portals      []string `json:"portals"`
+}
+
+// targetDevPath returns the suffix of the devices of the LUN under /dev/disk/by-path
+func (v *stagedVolume) targetDevPath() string {
+	return fmt.Sprintf("%s-lun-%d", v.IQN, v.MappingIndex)
+}
+
+func stagedVolumePath(dir string, volID string) string {
+	// volume IDs may contain '/'
+	return filepath.Join(dir, url.PathEscape(volID)+".json")
+}
+
+// saveStagedVolume saves the target the volume is staged from
+func saveStagedVolume(dir string, volID string, v *stagedVolume) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first not to leave a partially written file
+	path := stagedVolumePath(dir, volID)
+	if err = ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadStagedVolume returns the target the volume is staged from,
+// or nil if it has not been saved, e.g. the volume is staged by an older version of the driver
+func loadStagedVolume(dir string, volID string) (*stagedVolume, error) {
+	data, err := ioutil.ReadFile(stagedVolumePath(dir, volID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	v := &stagedVolume{}
+	if err = json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("Invalid staged volume %s: %v", volID, err)
+	}
+	return v, nil
+}
+
+// removeStagedVolume removes the target of the volume once the volume is unstaged
+func removeStagedVolume(dir string, volID string) error {
+	err := os.Remove(stagedVolumePath(dir, volID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
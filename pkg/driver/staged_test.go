@@ -0,0 +1,66 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestStagedVolume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "synology-csi")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "staged")
+	volID := makeVolumeID("nas1", 12, 1, "7a9121bc-ef10-4fbe-80ef-2d552b94aaaa")
+
+	// volumes staged by older versions
+	staged, err := loadStagedVolume(dir, volID)
+	assert.Nil(t, err)
+	assert.Nil(t, staged)
+
+	saved := &stagedVolume{
+		IQN:          "iqn.2000-01.com.synology:kube-csi-pvc-1",
+		MappingIndex: 1,
+		Portals:      []string{"10.0.1.10", "10.0.2.10"},
+	}
+	assert.Nil(t, saveStagedVolume(dir, volID, saved))
+
+	staged, err = loadStagedVolume(dir, volID)
+	assert.Nil(t, err)
+	assert.Equal(t, saved, staged)
+	assert.Equal(t, "iqn.2000-01.com.synology:kube-csi-pvc-1-lun-1", staged.targetDevPath())
+
+	// the volume is staged again
+	assert.Nil(t, saveStagedVolume(dir, volID, saved))
+
+	assert.Nil(t, removeStagedVolume(dir, volID))
+	staged, err = loadStagedVolume(dir, volID)
+	assert.Nil(t, err)
+	assert.Nil(t, staged)
+
+	// unstaged again
+	assert.Nil(t, removeStagedVolume(dir, volID))
+}
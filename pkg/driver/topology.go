@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var errNoAccessibleBackend = fmt.Errorf("No backend is accessible from the requisite topology")
+
+// NodeTopologyFromLabels returns topology segments of the node
+// from the values of the given labels of the kubernetes node object
+func NodeTopologyFromLabels(nodeName string, labelKeys []string) (map[string]string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := client.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	segments := map[string]string{}
+	for _, key := range labelKeys {
+		value, ok := node.Labels[key]
+		if !ok {
+			return nil, fmt.Errorf("Node %s does not have label %s", nodeName, key)
+		}
+		segments[key] = value
+	}
+
+	glog.V(3).Infof("Topology of node %s from labels: %v", nodeName, segments)
+
+	return segments, nil
+}
+
+// accessibleFrom returns true if the backend can be reached from the topology segments,
+// a backend without topology is accessible from anywhere
+func (b *backend) accessibleFrom(segments map[string]string) bool {
+	for key, value := range b.topology {
+		if segments[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// accessibleTopology returns the topology of volumes created on the backend
+func (b *backend) accessibleTopology() []*csi.Topology {
+	if len(b.topology) == 0 {
+		return nil
+	}
+
+	segments := map[string]string{}
+	for key, value := range b.topology {
+		segments[key] = value
+	}
+
+	return []*csi.Topology{{Segments: segments}}
+}
+
+// selectBackend returns the backend to create a volume on.
+//
+// If name is empty, backends are tried in order. The backend accessible from
+// the first preferred topology wins, and then the one accessible from any requisite topology.
+func (l backendList) selectBackend(name string, requirements *csi.TopologyRequirement) (*backend, error) {
+	candidates := l
+	if name != "" {
+		b, err := l.get(name)
+		if err != nil {
+			return nil, err
+		}
+		candidates = backendList{b}
+	} else if len(l) == 0 {
+		return nil, fmt.Errorf("No backend is configured")
+	}
+
+	for _, topology := range requirements.GetPreferred() {
+		for _, b := range candidates {
+			if b.accessibleFrom(topology.GetSegments()) {
+				return b, nil
+			}
+		}
+	}
+
+	requisite := requirements.GetRequisite()
+	if len(requisite) == 0 {
+		return candidates[0], nil
+	}
+
+	for _, topology := range requisite {
+		for _, b := range candidates {
+			if b.accessibleFrom(topology.GetSegments()) {
+				return b, nil
+			}
+		}
+	}
+
+	return nil, errNoAccessibleBackend
+}
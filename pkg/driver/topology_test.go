@@ -0,0 +1,135 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestSelectBackend(t *testing.T) {
+	zoneKey := "topology.kubernetes.io/zone"
+	nas1 := &backend{name: "nas1", topology: map[string]string{zoneKey: "a"}}
+	nas2 := &backend{name: "nas2", topology: map[string]string{zoneKey: "b"}}
+	backends := backendList{nas1, nas2}
+
+	zone := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{zoneKey: name}}
+	}
+
+	// no requirements
+	b, err := backends.selectBackend("", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, nas1, b)
+
+	b, err = backends.selectBackend("nas2", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, nas2, b)
+
+	// preferred topology wins
+	b, err = backends.selectBackend("", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("a"), zone("b")},
+		Preferred: []*csi.Topology{zone("b"), zone("a")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, nas2, b)
+
+	b, err = backends.selectBackend("", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("c"), zone("b")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, nas2, b)
+
+	// no backend in the requisite topology
+	_, err = backends.selectBackend("", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("c")},
+	})
+	assert.Equal(t, errNoAccessibleBackend, err)
+
+	_, err = backends.selectBackend("nas1", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("b")},
+	})
+	assert.Equal(t, errNoAccessibleBackend, err)
+
+	// backends without topology are accessible from anywhere
+	nas3 := &backend{name: "nas3"}
+	b, err = backendList{nas3}.selectBackend("", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("c")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, nas3, b)
+	assert.Nil(t, nas3.accessibleTopology())
+}
+
+func TestGetCapacity(t *testing.T) {
+	zoneKey := "topology.kubernetes.io/zone"
+	nas1, _, _ := newFakeBackend("nas1")
+	nas1.topology = map[string]string{zoneKey: "a"}
+	nas1.volumeAPI.(*fakeVolumeAPI).volumes[0].SizeFreeByte = 100 << 30
+	nas2, _, _ := newFakeBackend("nas2")
+	nas2.topology = map[string]string{zoneKey: "b"}
+	nas2.volumeAPI.(*fakeVolumeAPI).volumes[0].SizeFreeByte = 200 << 30
+	cs := newTestControllerServer(backendList{nas1, nas2})
+
+	getCapacity := func(zone string, params map[string]string) (int64, error) {
+		req := &csi.GetCapacityRequest{Parameters: params}
+		if zone != "" {
+			req.AccessibleTopology = &csi.Topology{Segments: map[string]string{zoneKey: zone}}
+		}
+		resp, err := cs.GetCapacity(context.Background(), req)
+		return resp.GetAvailableCapacity(), err
+	}
+
+	// each segment reports the capacity of its backend
+	capacity, err := getCapacity("a", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100<<30), capacity)
+
+	capacity, err = getCapacity("b", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200<<30), capacity)
+
+	// no backend in the segment
+	capacity, err = getCapacity("c", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), capacity)
+
+	capacity, err = getCapacity("a", map[string]string{"backend": "nas2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), capacity)
+
+	// the default backend without topology
+	capacity, err = getCapacity("", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100<<30), capacity)
+
+	capacity, err = getCapacity("", map[string]string{"backend": "nas2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200<<30), capacity)
+
+	_, err = getCapacity("", map[string]string{"backend": "nas3"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
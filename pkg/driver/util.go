@@ -21,32 +21,167 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
+)
+
+const (
+	// keys of the secrets for chap authentication
+	secretKeyUser           = "user"
+	secretKeyPassword       = "password"
+	secretKeyMutualUser     = "mutualUser"
+	secretKeyMutualPassword = "mutualPassword"
+)
+
+const (
+	// values of the provisioning parameter
+	provisioningThin  = "thin"
+	provisioningThick = "thick"
+
+	defaultProvisioning = provisioningThin
+)
+
+var (
+	// lunTypes contains types of LUNs for each provisioning, by the file system of the location
+	lunTypes = map[string]map[string]string{
+		storage.FSTypeExt4: {
+			provisioningThin:  iscsi.LunTypeThin,
+			provisioningThick: iscsi.LunTypeFile,
+		},
+		storage.FSTypeBtrfs: {
+			provisioningThin:  iscsi.LunTypeBlun,
+			provisioningThick: iscsi.LunTypeBlunThick,
+		},
+	}
+
+	// validLunTypes contains the types of LUNs DSM accepts, which can be given by the type parameter
+	validLunTypes = []string{
+		iscsi.LunTypeBlock,
+		iscsi.LunTypeFile,
+		iscsi.LunTypeThin,
+		iscsi.LunTypeAdv,
+		iscsi.LunTypeSink,
+		iscsi.LunTypeCinder,
+		iscsi.LunTypeCinderBLUN,
+		iscsi.LunTypeCinderBLUNThick,
+		iscsi.LunTypeBlun,
+		iscsi.LunTypeBlunThick,
+		iscsi.LunTypeBlunSink,
+		iscsi.LunTypeBlunThickSink,
+	}
 )
 
-func makeVolumeID(targetID int, mappingIndex int) string {
-	return fmt.Sprintf("%d.%d", targetID, mappingIndex)
+// chapCredentials contains credentials for chap authentication,
+// user/password authenticate the initiator to the target, and
+// mutualUser/mutualPassword authenticate the target to the initiator
+type chapCredentials struct {
+	authType int
+
+	user           string
+	password       string
+	mutualUser     string
+	mutualPassword string
 }
 
-func parseVolumeID(volumeID string) (int, int, error) {
-	tokens := strings.Split(volumeID, ".")
+// IDs of objects on a named backend are prefixed with the name of the backend,
+// e.g. nas1:<uuid> for a snapshot
+const backendIDSeparator = ":"
 
-	if len(tokens) != 2 {
-		return 0, 0, fmt.Errorf(
-			"Invalid volume ID: %s", volumeID)
+func qualifyID(backendName string, id string) string {
+	if backendName == "" {
+		return id
 	}
+	return backendName + backendIDSeparator + id
+}
 
-	targetID, err := strconv.Atoi(tokens[0])
+func splitQualifiedID(qualifiedID string) (string, string) {
+	tokens := strings.SplitN(qualifiedID, backendIDSeparator, 2)
+	if len(tokens) == 1 {
+		return "", tokens[0]
+	}
+	return tokens[0], tokens[1]
+}
+
+// Volume IDs have the form of v1:<backend>:<target id>.<mapping index>:<lun uuid>,
+// where backend is empty for the default backend.
+//
+// IDs created by older versions of the driver do not have the LUN UUID,
+// and have the form of <target id>.<mapping index> or <backend>:<target id>.<mapping index>
+const volumeIDVersion = "v1"
+
+type volumeID struct {
+	backendName  string
+	targetID     int
+	mappingIndex int
+	// uuid of the LUN, empty for legacy volume IDs
+	lunUUID string
+}
+
+func makeVolumeID(backendName string, targetID int, mappingIndex int, lunUUID string) string {
+	return strings.Join([]string{
+		volumeIDVersion,
+		backendName,
+		fmt.Sprintf("%d.%d", targetID, mappingIndex),
+		lunUUID,
+	}, backendIDSeparator)
+}
+
+func parseVolumeID(id string) (*volumeID, error) {
+	volID := &volumeID{}
+
+	var mappingID string
+	tokens := strings.Split(id, backendIDSeparator)
+	switch {
+	case len(tokens) == 1:
+		// legacy ID of the default backend
+		mappingID = tokens[0]
+	case len(tokens) == 2:
+		// legacy ID of a named backend
+		volID.backendName = tokens[0]
+		mappingID = tokens[1]
+	case len(tokens) == 4 && tokens[0] == volumeIDVersion:
+		volID.backendName = tokens[1]
+		mappingID = tokens[2]
+		volID.lunUUID = tokens[3]
+		if volID.lunUUID == "" {
+			return nil, fmt.Errorf("Invalid volume ID: %s", id)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid volume ID: %s", id)
+	}
+
+	mappingTokens := strings.Split(mappingID, ".")
+	if len(mappingTokens) != 2 {
+		return nil, fmt.Errorf("Invalid volume ID: %s", id)
+	}
+
+	var err error
+	volID.targetID, err = strconv.Atoi(mappingTokens[0])
 	if err != nil {
-		return 0, 0, fmt.Errorf(
-			"Invalid volume ID: %s", volumeID)
+		return nil, fmt.Errorf("Invalid volume ID: %s", id)
 	}
-	mappingIndex, err := strconv.Atoi(tokens[1])
+	volID.mappingIndex, err = strconv.Atoi(mappingTokens[1])
 	if err != nil {
-		return 0, 0, fmt.Errorf(
-			"Invalid volume ID: %s", volumeID)
+		return nil, fmt.Errorf("Invalid volume ID: %s", id)
 	}
 
-	return targetID, mappingIndex, nil
+	return volID, nil
+}
+
+func makeSnapshotID(backendName string, uuid string) string {
+	return qualifyID(backendName, uuid)
+}
+
+func parseSnapshotID(snapshotID string) (string, string, error) {
+	backendName, uuid := splitQualifiedID(snapshotID)
+	if uuid == "" {
+		return "", "", fmt.Errorf("Invalid snapshot ID: %s", snapshotID)
+	}
+
+	return backendName, uuid, nil
 }
 
 func validateCapacity(requestBytes, limitBytes int64) (int64, error) {
@@ -68,3 +203,88 @@ func validateCapacity(requestBytes, limitBytes int64) (int64, error) {
 	}
 	return (requestBytes-1)>>30 + 1, nil
 }
+
+func parseChapSecrets(secrets map[string]string) (*chapCredentials, error) {
+	chap := &chapCredentials{
+		authType: iscsi.TargetAuthTypeNone,
+	}
+
+	user, present := secrets[secretKeyUser]
+	if !present {
+		if _, present := secrets[secretKeyMutualUser]; present {
+			return nil, errors.New("user is required to provide mutual chap authentication")
+		}
+		return chap, nil
+	}
+
+	password, present := secrets[secretKeyPassword]
+	if !present {
+		return nil, errors.New("password is required to provide chap authentication")
+	}
+
+	chap.authType = iscsi.TargetAuthTypeSingleChap
+	chap.user = user
+	chap.password = password
+
+	mutualUser, present := secrets[secretKeyMutualUser]
+	if !present {
+		return chap, nil
+	}
+
+	mutualPassword, present := secrets[secretKeyMutualPassword]
+	if !present {
+		return nil, errors.New("mutualPassword is required to provide mutual chap authentication")
+	}
+
+	chap.authType = iscsi.TargetAuthTypeMutualChap
+	chap.mutualUser = mutualUser
+	chap.mutualPassword = mutualPassword
+
+	return chap, nil
+}
+
+// isReadOnlyMode returns true if the access mode does not allow writing to the volume
+func isReadOnlyMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// isSingleNodeMode returns true if the volume can be published to only one node at a time
+func isSingleNodeMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
+
+// selectLunType returns the type of the LUN to create on the location with the file system,
+// from either the type or the provisioning parameter.
+// The type is used as it is if it is a type of DSM, as the file system may support other types
+// than the ones selected for the provisioning.
+func selectLunType(fsType string, volType string, provisioning string) (string, error) {
+	if volType != "" {
+		if provisioning != "" {
+			return "", errors.New("Only one of type and provisioning can be given")
+		}
+
+		for _, t := range validLunTypes {
+			if t == volType {
+				return volType, nil
+			}
+		}
+		return "", fmt.Errorf("Invalid type %s, valid types: %s", volType, strings.Join(validLunTypes, ", "))
+	}
+
+	if provisioning == "" {
+		provisioning = defaultProvisioning
+	}
+	if provisioning != provisioningThin && provisioning != provisioningThick {
+		return "", fmt.Errorf("Invalid provisioning %s, valid options: %s, %s",
+			provisioning, provisioningThin, provisioningThick)
+	}
+
+	types, known := lunTypes[fsType]
+	if !known {
+		return "", fmt.Errorf("Unable to select the type of LUN for %s file system, type must be given", fsType)
+	}
+
+	return types[provisioning], nil
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/api/iscsi"
+	"github.com/jparklab/synology-csi/pkg/synology/api/storage"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestParseChapSecrets(t *testing.T) {
+	// no auth
+	chap, err := parseChapSecrets(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, iscsi.TargetAuthTypeNone, chap.authType)
+
+	// single chap
+	chap, err = parseChapSecrets(map[string]string{
+		"user":     "initiator",
+		"password": "initiator-password",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, iscsi.TargetAuthTypeSingleChap, chap.authType)
+	assert.Equal(t, "initiator", chap.user)
+	assert.Equal(t, "initiator-password", chap.password)
+
+	// mutual chap
+	chap, err = parseChapSecrets(map[string]string{
+		"user":           "initiator",
+		"password":       "initiator-password",
+		"mutualUser":     "target",
+		"mutualPassword": "target-password",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, iscsi.TargetAuthTypeMutualChap, chap.authType)
+	assert.Equal(t, "target", chap.mutualUser)
+	assert.Equal(t, "target-password", chap.mutualPassword)
+
+	// missing passwords
+	_, err = parseChapSecrets(map[string]string{"user": "initiator"})
+	assert.Error(t, err)
+
+	_, err = parseChapSecrets(map[string]string{
+		"user":       "initiator",
+		"password":   "initiator-password",
+		"mutualUser": "target",
+	})
+	assert.Error(t, err)
+
+	// mutual chap without single chap
+	_, err = parseChapSecrets(map[string]string{
+		"mutualUser":     "target",
+		"mutualPassword": "target-password",
+	})
+	assert.Error(t, err)
+}
+
+func TestParseVolumeID(t *testing.T) {
+	lunUUID := "fd993a34-15ba-44e6-a60c-62d17a3430c8"
+
+	id := makeVolumeID("nas2", 8, 1, lunUUID)
+	assert.Equal(t, "v1:nas2:8.1:"+lunUUID, id)
+	volID, err := parseVolumeID(id)
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeID{"nas2", 8, 1, lunUUID}, volID)
+
+	id = makeVolumeID("", 8, 1, lunUUID)
+	assert.Equal(t, "v1::8.1:"+lunUUID, id)
+	volID, err = parseVolumeID(id)
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeID{"", 8, 1, lunUUID}, volID)
+
+	// legacy volume IDs
+	volID, err = parseVolumeID("8.1")
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeID{"", 8, 1, ""}, volID)
+
+	volID, err = parseVolumeID("nas2:8.1")
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeID{"nas2", 8, 1, ""}, volID)
+
+	for _, id := range []string{
+		"", "8", "nas2:8", "a.1", "8.b", "nas2:8.1.2",
+		"v1:nas2:8.1:", "v2:nas2:8.1:" + lunUUID, "v1:nas2:8:" + lunUUID,
+	} {
+		_, err = parseVolumeID(id)
+		assert.NotNil(t, err, id)
+	}
+}
+
+func TestSelectLunType(t *testing.T) {
+	testCases := []struct {
+		fsType       string
+		volType      string
+		provisioning string
+		expected     string
+		valid        bool
+	}{
+		// defaults to thin provisioning
+		{storage.FSTypeExt4, "", "", iscsi.LunTypeThin, true},
+		{storage.FSTypeBtrfs, "", "", iscsi.LunTypeBlun, true},
+
+		{storage.FSTypeExt4, "", provisioningThick, iscsi.LunTypeFile, true},
+		{storage.FSTypeBtrfs, "", provisioningThick, iscsi.LunTypeBlunThick, true},
+		{storage.FSTypeBtrfs, "", "lazy", "", false},
+
+		{storage.FSTypeBtrfs, iscsi.LunTypeBlunThick, "", iscsi.LunTypeBlunThick, true},
+		{storage.FSTypeBtrfs, iscsi.LunTypeBlun, provisioningThin, "", false},
+
+		// any type of DSM is accepted
+		{storage.FSTypeBtrfs, iscsi.LunTypeBlunSink, "", iscsi.LunTypeBlunSink, true},
+		{storage.FSTypeExt4, iscsi.LunTypeAdv, "", iscsi.LunTypeAdv, true},
+		{storage.FSTypeExt4, iscsi.LunTypeBlock, "", iscsi.LunTypeBlock, true},
+		{storage.FSTypeBtrfs, "CUSTOM", "", "", false},
+		{storage.FSTypeExt4, "blun", "", "", false},
+
+		// unknown file systems require the type
+		{"zfs", "", provisioningThin, "", false},
+		{"zfs", iscsi.LunTypeFile, "", iscsi.LunTypeFile, true},
+		{"zfs", "CUSTOM", "", "", false},
+	}
+
+	for _, tc := range testCases {
+		volType, err := selectLunType(tc.fsType, tc.volType, tc.provisioning)
+		if tc.valid {
+			assert.NoError(t, err, tc)
+			assert.Equal(t, tc.expected, volType, tc)
+		} else {
+			assert.Error(t, err, tc)
+		}
+	}
+
+	// valid options are listed
+	_, err := selectLunType(storage.FSTypeBtrfs, "CUSTOM", "")
+	assert.EqualError(t, err, "Invalid type CUSTOM, valid types: "+
+		"BLOCK, FILE, THIN, ADV, SINK, CINDER, CINDER_BLUN, CINDER_BLUN_THICK, BLUN, BLUN_THICK, BLUN_SINK, BLUN_THICK_SINK")
+}
@@ -109,6 +109,8 @@ type Lun struct {
 	Type     interface{} `json:"type"` // type can be either int or string
 	UUID     string      `json:"uuid"`
 
+	Description string `json:"description"`
+
 	IsMapped bool   `json:"is_mapped"`
 	Status   string `json:"status"`
 }
@@ -131,6 +133,17 @@ type LunAPI interface {
 		id string,
 		size int64,
 	) error
+	SetDescription(id string, description string) error
+	Clone(
+		srcID string, // uuid of the source LUN
+		name string, // name of the new LUN
+		location string, // location of the new LUN(e.g. /volume1)
+	) (*Lun, error)
+	CloneSnapshot(
+		srcID string, // uuid of the LUN the snapshot is taken from
+		snapshotID string, // uuid of the snapshot
+		name string, // name of the new LUN
+	) (*Lun, error)
 }
 
 type lunAPI struct {
@@ -233,3 +246,63 @@ func (l *lunAPI) Update(
 
 	return err
 }
+
+// SetDescription sets the description of the LUN
+func (l *lunAPI) SetDescription(id string, description string) error {
+	_, err := l.apiEntry.Post("set", url.Values{
+		"uuid":        {fmt.Sprintf("\"%s\"", id)},
+		"description": {fmt.Sprintf("\"%s\"", description)},
+	})
+
+	glog.V(5).Infof("Set the description of a LUN %s: %s", id, description)
+
+	return err
+}
+
+// Clone creates a new LUN with the contents of the source LUN
+func (l *lunAPI) Clone(
+	srcID string,
+	name string,
+	location string,
+) (*Lun, error) {
+	data, err := l.apiEntry.Post("clone", url.Values{
+		"src_lun_uuid": {fmt.Sprintf("\"%s\"", srcID)},
+		"dst_lun_name": {fmt.Sprintf("\"%s\"", name)},
+		"dst_location": {fmt.Sprintf("\"%s\"", location)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uuid := string(*data["dst_lun_uuid"])
+	// uuid can be quoted
+	uuid = strings.Trim(uuid, "\"")
+
+	glog.V(5).Infof("Cloned LUN %s to %s", srcID, uuid)
+
+	return l.Get(uuid)
+}
+
+// CloneSnapshot creates a new LUN with the contents of the snapshot
+func (l *lunAPI) CloneSnapshot(
+	srcID string,
+	snapshotID string,
+	name string,
+) (*Lun, error) {
+	data, err := l.apiEntry.Post("clone_snapshot", url.Values{
+		"src_lun_uuid":    {fmt.Sprintf("\"%s\"", srcID)},
+		"snapshot_uuid":   {fmt.Sprintf("\"%s\"", snapshotID)},
+		"cloned_lun_name": {fmt.Sprintf("\"%s\"", name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uuid := string(*data["cloned_lun_uuid"])
+	// uuid can be quoted
+	uuid = strings.Trim(uuid, "\"")
+
+	glog.V(5).Infof("Cloned snapshot %s of LUN %s to %s", snapshotID, srcID, uuid)
+
+	return l.Get(uuid)
+}
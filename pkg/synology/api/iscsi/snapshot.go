@@ -0,0 +1,167 @@
+/*
+ * Copyright 2018 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iscsi
+
+import (
+	"fmt"
+	"strings"
+
+	"encoding/json"
+	"net/url"
+
+	"github.com/golang/glog"
+
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+const (
+	// SnapshotStatusHealthy is the status of a snapshot that is ready to use
+	SnapshotStatusHealthy = "Healthy"
+
+	snapshotTakenBy = "synology-csi"
+)
+
+/*************************************************************
+ * Snapshot Object
+ * Example Snapshot
+	{
+		"create_time": 1588490573,
+		"description": "",
+		"is_app_consistent": false,
+		"is_locked": false,
+		"name": "kube-csi-snapshot-1",
+		"parent_uuid": "fd993a34-15ba-44e6-a60c-62d17a3430c8",
+		"root_path": "/volume1",
+		"snapshot_id": 1,
+		"status": "Healthy",
+		"taken_by": "synology-csi",
+		"total_size": 53687091200,
+		"uuid": "6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"
+	}
+*/
+
+// Snapshot represents a snapshot of a LUN
+type Snapshot struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	ParentUUID string `json:"parent_uuid"`
+	Status     string `json:"status"`
+	TotalSize  int64  `json:"total_size"`
+	CreateTime int64  `json:"create_time"`
+	RootPath   string `json:"root_path"`
+}
+
+/*************************************************************
+ * API for Snapshot
+ *************************************************************/
+
+// SnapshotAPI defines snapshot functions of a LUN
+type SnapshotAPI interface {
+	List(lunUUID string) ([]Snapshot, error)
+	Get(uuid string) (*Snapshot, error)
+	Create(
+		lunUUID string, // uuid of the source LUN
+		name string, // name of the snapshot
+		description string, // description of the snapshot
+	) (*Snapshot, error)
+	Delete(uuid string) error
+}
+
+type snapshotAPI struct {
+	apiEntry core.APIEntry
+}
+
+// NewSnapshotAPI creates a SnapshotAPI object
+func NewSnapshotAPI(s core.Session) SnapshotAPI {
+	// snapshot methods are provided by the LUN api
+	entry := core.NewAPIEntry(s, Path, "SYNO.Core.ISCSI.LUN", "1")
+
+	return &snapshotAPI{
+		apiEntry: entry,
+	}
+}
+
+// List returns snapshots taken from the LUN of the given UUID
+func (s *snapshotAPI) List(lunUUID string) ([]Snapshot, error) {
+	data, err := s.apiEntry.Get("list_snapshot", url.Values{
+		"src_lun_uuid": {fmt.Sprintf("\"%s\"", lunUUID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	if jsonErr := json.Unmarshal(*data["snapshots"], &snapshots); jsonErr != nil {
+		glog.Errorf("Failed to parse snapshot list: %s(%s)", *data["snapshots"], jsonErr)
+		return nil, jsonErr
+	}
+
+	return snapshots, nil
+}
+
+// Get finds snapshot for the given UUID
+func (s *snapshotAPI) Get(uuid string) (*Snapshot, error) {
+	data, err := s.apiEntry.Get("get_snapshot", url.Values{
+		"snapshot_uuid": {fmt.Sprintf("\"%s\"", uuid)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if jsonErr := json.Unmarshal(*data["snapshot"], &snapshot); jsonErr != nil {
+		glog.Errorf("Failed to parse snapshot: %s(%s)", *data["snapshot"], jsonErr)
+		return nil, jsonErr
+	}
+
+	return &snapshot, nil
+}
+
+func (s *snapshotAPI) Create(
+	lunUUID string,
+	name string,
+	description string,
+) (*Snapshot, error) {
+	data, err := s.apiEntry.Post("take_snapshot", url.Values{
+		"src_lun_uuid":      {fmt.Sprintf("\"%s\"", lunUUID)},
+		"snapshot_name":     {fmt.Sprintf("\"%s\"", name)},
+		"description":       {fmt.Sprintf("\"%s\"", description)},
+		"taken_by":          {fmt.Sprintf("\"%s\"", snapshotTakenBy)},
+		"is_app_consistent": {"false"},
+		"is_locked":         {"false"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uuid := string(*data["snapshot_uuid"])
+	// uuid can be quoted
+	uuid = strings.Trim(uuid, "\"")
+
+	glog.V(5).Infof("Created a snapshot: %s", uuid)
+
+	return s.Get(uuid)
+}
+
+func (s *snapshotAPI) Delete(uuid string) error {
+	_, err := s.apiEntry.Post("delete_snapshot", url.Values{
+		"snapshot_uuid": {fmt.Sprintf("\"%s\"", uuid)},
+		"deleted_by":    {fmt.Sprintf("\"%s\"", snapshotTakenBy)},
+	})
+
+	return err
+}
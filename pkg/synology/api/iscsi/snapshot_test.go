@@ -0,0 +1,148 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iscsi
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/jparklab/synology-csi/pkg/synology/core"
+)
+
+var encodedSnapshot = []byte(`{
+	"create_time": 1588490573,
+	"description": "",
+	"is_app_consistent": false,
+	"is_locked": false,
+	"name": "kube-csi-snapshot-1",
+	"parent_uuid": "fd993a34-15ba-44e6-a60c-62d17a3430c8",
+	"root_path": "/volume1",
+	"snapshot_id": 1,
+	"status": "Healthy",
+	"taken_by": "synology-csi",
+	"total_size": 53687091200,
+	"uuid": "6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"
+}`)
+
+func rawMessage(s string) *json.RawMessage {
+	raw := json.RawMessage(s)
+	return &raw
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestListSnapshots(t *testing.T) {
+	entry := testApiEntry{}
+	data := map[string]*json.RawMessage{
+		"snapshots": rawMessage("[" + string(encodedSnapshot) + "]"),
+	}
+
+	entry.On("Get", "list_snapshot", url.Values{
+		"src_lun_uuid": {`"fd993a34-15ba-44e6-a60c-62d17a3430c8"`},
+	}).Return(data, nil)
+
+	api := &snapshotAPI{
+		apiEntry: &entry,
+	}
+
+	snapshots, err := api.List("fd993a34-15ba-44e6-a60c-62d17a3430c8")
+	assert.NoError(t, err)
+	assert.Equal(t, []Snapshot{
+		{
+			Name:       "kube-csi-snapshot-1",
+			UUID:       "6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4",
+			ParentUUID: "fd993a34-15ba-44e6-a60c-62d17a3430c8",
+			Status:     SnapshotStatusHealthy,
+			TotalSize:  53687091200,
+			CreateTime: 1588490573,
+			RootPath:   "/volume1",
+		},
+	}, snapshots)
+}
+
+func TestGetSnapshot(t *testing.T) {
+	entry := testApiEntry{}
+	data := map[string]*json.RawMessage{"snapshot": (*json.RawMessage)(&encodedSnapshot)}
+
+	entry.On("Get", "get_snapshot", url.Values{
+		"snapshot_uuid": {`"6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"`},
+	}).Return(data, nil)
+	notFound := &core.APIError{
+		API: "SYNO.Core.ISCSI.LUN", Method: "get_snapshot", Code: core.ErrorCodeSnapshotNotFound}
+	entry.On("Get", "get_snapshot", mock.Anything).Return(nil, notFound)
+
+	api := &snapshotAPI{
+		apiEntry: &entry,
+	}
+
+	snapshot, err := api.Get("6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4")
+	assert.NoError(t, err)
+	assert.Equal(t, "kube-csi-snapshot-1", snapshot.Name)
+	assert.Equal(t, "fd993a34-15ba-44e6-a60c-62d17a3430c8", snapshot.ParentUUID)
+
+	// errors of DSM are returned as they are
+	_, err = api.Get("00000000-0000-0000-0000-000000000000")
+	assert.True(t, core.IsAPIError(err, core.ErrorCodeSnapshotNotFound))
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	entry := testApiEntry{}
+	entry.On("Post", "take_snapshot", url.Values{
+		"src_lun_uuid":      {`"fd993a34-15ba-44e6-a60c-62d17a3430c8"`},
+		"snapshot_name":     {`"kube-csi-snapshot-1"`},
+		"description":       {`"Snapshot of volume 1"`},
+		"taken_by":          {`"synology-csi"`},
+		"is_app_consistent": {"false"},
+		"is_locked":         {"false"},
+	}).Return(map[string]*json.RawMessage{
+		// the UUID is quoted
+		"snapshot_uuid": rawMessage(`"6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"`),
+	}, nil)
+	entry.On("Get", "get_snapshot", url.Values{
+		"snapshot_uuid": {`"6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"`},
+	}).Return(map[string]*json.RawMessage{"snapshot": (*json.RawMessage)(&encodedSnapshot)}, nil)
+
+	api := &snapshotAPI{
+		apiEntry: &entry,
+	}
+
+	snapshot, err := api.Create(
+		"fd993a34-15ba-44e6-a60c-62d17a3430c8", "kube-csi-snapshot-1", "Snapshot of volume 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4", snapshot.UUID)
+	entry.AssertExpectations(t)
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	entry := testApiEntry{}
+	entry.On("Post", "delete_snapshot", url.Values{
+		"snapshot_uuid": {`"6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"`},
+		"deleted_by":    {`"synology-csi"`},
+	}).Return(map[string]*json.RawMessage{}, nil)
+
+	api := &snapshotAPI{
+		apiEntry: &entry,
+	}
+
+	assert.NoError(t, api.Delete("6d1cc4ba-8d30-4d2e-9b1b-1a2ea3b0c2a4"))
+	entry.AssertExpectations(t)
+}
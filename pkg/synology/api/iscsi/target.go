@@ -35,6 +35,21 @@ const (
 	TargetAuthTypeSingleChap = 1
 	// TargetAuthTypeMutualChap is for mutual chap
 	TargetAuthTypeMutualChap = 2
+
+	// TargetDefaultACLIQN is the IQN of the ACL applied to initiators not in the ACL list
+	TargetDefaultACLIQN = "iqn.2000-01.com.synology:default.acl"
+
+	// TargetPermissionReadWrite allows an initiator to read and write LUNs of the target
+	TargetPermissionReadWrite = "rw"
+	// TargetPermissionReadOnly allows an initiator to read LUNs of the target
+	TargetPermissionReadOnly = "ro"
+	// TargetPermissionNoAccess denies an initiator to access the target
+	TargetPermissionNoAccess = "no"
+
+	// TargetPortalInterfaceAll is the interface name of a portal listening on all interfaces
+	TargetPortalInterfaceAll = "all"
+	// TargetPortalDefaultPort is the default port of a network portal
+	TargetPortalDefaultPort = 3260
 )
 
 var (
@@ -111,11 +126,34 @@ type Target struct {
 		MappingIndex int    `json:"mapping_index"`
 	} `json:"mapped_luns"`
 
+	ACLs              []TargetACL     `json:"acls"`
+	NetworkPortals    []NetworkPortal `json:"network_portals"`
+	ConnectedSessions []TargetSession `json:"connected_sessions"`
+
 	MaxSessions int    `json:"max_sessions"`
 	IsEnabled   bool   `json:"is_enabled"`
 	Status      string `json:"status"`
 }
 
+// TargetACL is the permission of an initiator on a target
+type TargetACL struct {
+	IQN        string `json:"iqn"`
+	Permission string `json:"permission"` // see TargetPermission
+}
+
+// TargetSession is a session of an initiator logged in to a target
+type TargetSession struct {
+	IQN string `json:"iqn"`
+	IP  string `json:"ip"`
+}
+
+// NetworkPortal is the network address a target accepts connections on
+type NetworkPortal struct {
+	InterfaceName string `json:"interface_name"`
+	IP            string `json:"ip"`
+	Port          int    `json:"port"`
+}
+
 /*************************************************************
  * API for Target
  *************************************************************/
@@ -130,11 +168,21 @@ type TargetAPI interface {
 		authType int, // see TargetAuthType
 		user string, // username, can be nil when authType is 0
 		password string, // password, can be nil when authType is 0
+		mutualUser string, // username of the target, can be nil unless authType is 2
+		mutualPassword string, // password of the target, can be nil unless authType is 2
 	) (*Target, error)
 	Delete(id int) error
 
 	MapLun(targetID int, lunUUIDs []string) error
 	UnmapLun(targetID int, lunUUIDs []string) error
+
+	// SetNetworkPortals sets network portals the target accepts connections on
+	SetNetworkPortals(targetID int, portals []NetworkPortal) error
+	// SetACLs replaces permissions of initiators on the target,
+	// the ACL of TargetDefaultACLIQN applies to initiators not in the list
+	SetACLs(targetID int, acls []TargetACL) error
+	// RestrictInitiator allows only the initiator to access the target with the permission
+	RestrictInitiator(targetID int, iqn string, permission string) error
 }
 
 type targetAPI struct {
@@ -195,6 +243,8 @@ func (t *targetAPI) Create(
 	authType int,
 	user string,
 	password string,
+	mutualUser string,
+	mutualPassword string,
 ) (*Target, error) {
 
 	params := url.Values{
@@ -207,12 +257,18 @@ func (t *targetAPI) Create(
 		params.Set("chap", "false")
 	} else {
 		params.Set("chap", "true")
-		// NOTE(jpark):
-		//	synology supports mutual chap, but we do not support here.
-		params.Set("mutual_chap", "false")
 		params.Set("user", user)
 		params.Set("password", password)
 		params.Set("password_confirm", password)
+
+		if authType == TargetAuthTypeMutualChap {
+			params.Set("mutual_chap", "true")
+			params.Set("mutual_user", mutualUser)
+			params.Set("mutual_password", mutualPassword)
+			params.Set("mutual_password_confirm", mutualPassword)
+		} else {
+			params.Set("mutual_chap", "false")
+		}
 	}
 
 	data, err := t.apiEntry.Post("create", params)
@@ -257,3 +313,43 @@ func (t *targetAPI) UnmapLun(targetID int, lunUUIDs []string) error {
 
 	return err
 }
+
+func (t *targetAPI) SetNetworkPortals(targetID int, portals []NetworkPortal) error {
+	encodedPortals, err := json.Marshal(portals)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.apiEntry.Post("set", url.Values{
+		"target_id":       {fmt.Sprintf("\"%d\"", targetID)},
+		"network_portals": {string(encodedPortals)},
+	})
+
+	return err
+}
+
+func (t *targetAPI) SetACLs(targetID int, acls []TargetACL) error {
+	encodedACLs, err := json.Marshal(acls)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.apiEntry.Post("set", url.Values{
+		"target_id": {fmt.Sprintf("\"%d\"", targetID)},
+		"acls":      {string(encodedACLs)},
+	})
+
+	return err
+}
+
+func (t *targetAPI) RestrictInitiator(targetID int, iqn string, permission string) error {
+	return t.SetACLs(targetID, RestrictedACLs(iqn, permission))
+}
+
+// RestrictedACLs returns ACLs that allow only the initiator to access a target
+func RestrictedACLs(iqn string, permission string) []TargetACL {
+	return []TargetACL{
+		{IQN: iqn, Permission: permission},
+		{IQN: TargetDefaultACLIQN, Permission: TargetPermissionNoAccess},
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iscsi
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type testApiEntry struct {
+	mock.Mock
+}
+
+func (m *testApiEntry) Get(method string, params url.Values) (map[string]*json.RawMessage, error) {
+	args := m.Called(method, params)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]*json.RawMessage), nil
+}
+
+func (m *testApiEntry) Post(method string, params url.Values) (map[string]*json.RawMessage, error) {
+	args := m.Called(method, params)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]*json.RawMessage), nil
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+func TestGetTarget(t *testing.T) {
+	entry := testApiEntry{}
+	encodedTarget := []byte(`{
+		"acls": [
+			{
+				"iqn": "iqn.2000-01.com.synology:default.acl",
+				"permission": "no"
+			},
+			{
+				"iqn": "iqn.1993-08.org.debian:01:node1",
+				"permission": "rw"
+			}
+		],
+		"auth_type": 0,
+		"connected_sessions": [],
+		"iqn": "iqn.2000-01.com.synology:kube-csi-pvc-1",
+		"is_enabled": true,
+		"mapped_luns": [
+			{
+				"lun_uuid": "7a9121bc-ef10-4fbe-80ef-2d552b94aaaa",
+				"mapping_index": 1
+			}
+		],
+		"max_sessions": 1,
+		"name": "kube-csi-pvc-1",
+		"network_portals": [
+			{
+				"interface_name": "all",
+				"ip": "",
+				"port": 3260
+			}
+		],
+		"status": "online",
+		"target_id": 12
+	}`)
+	data := map[string]*json.RawMessage{"target": (*json.RawMessage)(&encodedTarget)}
+
+	entry.On("Get", "get", mock.Anything).Return(data, nil)
+
+	api := &targetAPI{
+		apiEntry: &entry,
+	}
+
+	target, err := api.Get(12)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, target.TargetID)
+	assert.Equal(t, []TargetACL{
+		{IQN: TargetDefaultACLIQN, Permission: TargetPermissionNoAccess},
+		{IQN: "iqn.1993-08.org.debian:01:node1", Permission: TargetPermissionReadWrite},
+	}, target.ACLs)
+	assert.Equal(t, []NetworkPortal{
+		{InterfaceName: TargetPortalInterfaceAll, IP: "", Port: TargetPortalDefaultPort},
+	}, target.NetworkPortals)
+}
+
+func TestRestrictInitiator(t *testing.T) {
+	entry := testApiEntry{}
+	entry.On("Post", "set", url.Values{
+		"target_id": {`"12"`},
+		"acls": {`[{"iqn":"iqn.1993-08.org.debian:01:node1","permission":"ro"},` +
+			`{"iqn":"iqn.2000-01.com.synology:default.acl","permission":"no"}]`},
+	}).Return(map[string]*json.RawMessage{}, nil)
+
+	api := &targetAPI{
+		apiEntry: &entry,
+	}
+
+	err := api.RestrictInitiator(12, "iqn.1993-08.org.debian:01:node1", TargetPermissionReadOnly)
+	assert.NoError(t, err)
+	entry.AssertExpectations(t)
+}
+
+func TestSetNetworkPortals(t *testing.T) {
+	entry := testApiEntry{}
+	entry.On("Post", "set", url.Values{
+		"target_id":       {`"12"`},
+		"network_portals": {`[{"interface_name":"eth1","ip":"10.0.1.10","port":3260}]`},
+	}).Return(map[string]*json.RawMessage{}, nil)
+
+	api := &targetAPI{
+		apiEntry: &entry,
+	}
+
+	err := api.SetNetworkPortals(12, []NetworkPortal{
+		{InterfaceName: "eth1", IP: "10.0.1.10", Port: TargetPortalDefaultPort},
+	})
+	assert.NoError(t, err)
+	entry.AssertExpectations(t)
+}
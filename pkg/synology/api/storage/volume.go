@@ -57,9 +57,11 @@ type Volume struct {
 	VolumeId   int    `json:"volume_id"`
 	VolumePath string `json:"volume_path"`
 
-	FSType        string `json:"fs_type"`
-	SizeFreeByte  string `json:"size_free_byte"`
-	SizeTotalByte string `json:"size_total_byte"`
+	FSType string `json:"fs_type"`
+
+	// sizes are encoded as strings
+	SizeFreeByte  int64 `json:"size_free_byte,string"`
+	SizeTotalByte int64 `json:"size_total_byte,string"`
 
 	Status string `json:"status"`
 }
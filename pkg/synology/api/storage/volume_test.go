@@ -142,6 +142,8 @@ func TestGetVolume(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, vol1)
 	assert.Equal(t, vol1.VolumePath, "/volume1")
+	assert.Equal(t, vol1.SizeFreeByte, int64(3738201395200))
+	assert.Equal(t, vol1.SizeTotalByte, int64(7676309151744))
 
 	// Test if Get returns err when no volume found
 	vol2, err := api.Get("/volume2")
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jparklab/synology-csi/pkg/synology/options"
+)
+
+const (
+	defaultMaxIdleConns    = 10
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
+// NewHTTPClient creates an HTTP client to access the NAS with TLS, proxy and connection settings of the options
+func NewHTTPClient(synoOptions *options.SynologyOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: synoOptions.InsecureSkipVerify,
+	}
+
+	if synoOptions.CAFile != "" {
+		caCerts, err := ioutil.ReadFile(synoOptions.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file: %v", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("No certificate found in CA file %s", synoOptions.CAFile)
+		}
+	}
+
+	if synoOptions.CertFile != "" || synoOptions.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(synoOptions.CertFile, synoOptions.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if synoOptions.Proxy != "" {
+		proxyURL, err := url.Parse(synoOptions.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy %s: %v", synoOptions.Proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	maxIdleConns := synoOptions.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	idleConnTimeout := synoOptions.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// all requests go to the same NAS
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   synoOptions.Timeout,
+	}, nil
+}
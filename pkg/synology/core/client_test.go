@@ -0,0 +1,189 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/options"
+)
+
+// writePEM writes PEM blocks to a file in the directory, and returns its path
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	assert.NoError(t, err)
+	return path
+}
+
+/************************************************************
+ * Tests
+ ************************************************************/
+
+func TestHTTPClientTLS(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	}))
+	defer testServer.Close()
+
+	dir, err := ioutil.TempDir("", "client")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", testServer.Certificate().Raw)
+
+	testCases := []struct {
+		name    string
+		options options.SynologyOptions
+		success bool
+	}{
+		// the certificate of the test server is not signed by system CAs
+		{"system CAs", options.SynologyOptions{}, false},
+		{"CA file", options.SynologyOptions{CAFile: caFile}, true},
+		{"insecure", options.SynologyOptions{InsecureSkipVerify: true}, true},
+	}
+
+	for _, tc := range testCases {
+		client, err := NewHTTPClient(&tc.options)
+		assert.NoError(t, err, tc.name)
+
+		resp, err := client.Get(testServer.URL)
+		if tc.success {
+			assert.NoError(t, err, tc.name)
+			resp.Body.Close()
+		} else {
+			assert.Error(t, err, tc.name)
+		}
+	}
+
+	// invalid CA files are rejected
+	_, err = NewHTTPClient(&options.SynologyOptions{CAFile: filepath.Join(dir, "missing.crt")})
+	assert.Error(t, err)
+
+	invalidFile := filepath.Join(dir, "invalid.crt")
+	assert.NoError(t, ioutil.WriteFile(invalidFile, []byte("not a certificate"), 0600))
+	_, err = NewHTTPClient(&options.SynologyOptions{CAFile: invalidFile})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	}))
+	testServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	dir, err := ioutil.TempDir("", "client")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// use the certificate of the server as the client certificate
+	serverCert := testServer.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	assert.NoError(t, err)
+
+	certFile := writePEM(t, dir, "client.crt", "CERTIFICATE", serverCert.Certificate[0])
+	keyFile := writePEM(t, dir, "client.key", "PRIVATE KEY", key)
+
+	client, err := NewHTTPClient(&options.SynologyOptions{InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	_, err = client.Get(testServer.URL)
+	assert.Error(t, err)
+
+	client, err = NewHTTPClient(&options.SynologyOptions{
+		InsecureSkipVerify: true,
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+	})
+	assert.NoError(t, err)
+	resp, err := client.Get(testServer.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	_, err = NewHTTPClient(&options.SynologyOptions{CertFile: certFile})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		resp.Write([]byte("ok"))
+	}))
+	defer testServer.Close()
+
+	client, err := NewHTTPClient(&options.SynologyOptions{Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+
+	_, err = client.Get(testServer.URL)
+	assert.Error(t, err)
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		proxied = req.URL.String()
+		resp.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(&options.SynologyOptions{
+		Proxy:           proxy.URL,
+		MaxIdleConns:    4,
+		IdleConnTimeout: time.Minute,
+	})
+	assert.NoError(t, err)
+
+	resp, err := client.Get("http://nas.example.com:5000/webapi/query.cgi")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://nas.example.com:5000/webapi/query.cgi", proxied)
+
+	transport := client.Transport.(*http.Transport)
+	assert.Equal(t, 4, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+// Tests if the session sends requests with the given client
+func TestSessionClient(t *testing.T) {
+	var logins int32
+	testServer := httptest.NewTLSServer(newTestHandler(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{ "data": {}, "success": true }`))
+	}))
+	defer testServer.Close()
+
+	// the client trusts the certificate of the test server
+	s := NewSession(testServer.URL+"/webapi", "Core", testServer.Client())
+	sid, err := s.Login(testLoginOptions())
+	assert.NoError(t, err)
+	assert.Equal(t, "sid-1", sid)
+
+	_, err = NewAPIEntry(s, "entry.cgi", "TestAPI", "1").Post("set", url.Values{})
+	assert.NoError(t, err)
+}
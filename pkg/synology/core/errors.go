@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+)
+
+// Error codes common to all web APIs
+const (
+	ErrorCodeUnknown               = 100
+	ErrorCodeInvalidParameter      = 101
+	ErrorCodeNoSuchAPI             = 102
+	ErrorCodeNoSuchMethod          = 103
+	ErrorCodeNotSupportedInVersion = 104
+	ErrorCodeNoPermission          = 105
+	ErrorCodeSessionTimeout        = 106
+	ErrorCodeSessionInterrupted    = 107
+)
+
+// Error codes of SYNO.Core.ISCSI APIs, which are observed from DSM
+const (
+	ErrorCodeLunNoSpace            = 18990002
+	ErrorCodeLunBadType            = 18990500
+	ErrorCodeLunNotFound           = 18990505
+	ErrorCodeSnapshotNotFound      = 18990532
+	ErrorCodeLunDuplicatedName     = 18990538
+	ErrorCodeLunReachMaxCount      = 18990541
+	ErrorCodeTargetReachMaxCount   = 18990542
+	ErrorCodeSnapshotReachMaxCount = 18990543
+	ErrorCodeTargetNotFound        = 18990710
+	ErrorCodeTargetDuplicatedName  = 18990744
+)
+
+// errorCodeDescs contains descriptions of error codes specific to each API
+var errorCodeDescs = map[string]map[int]string{
+	"SYNO.Core.ISCSI.LUN": {
+		ErrorCodeLunNoSpace:            "Out of free space",
+		ErrorCodeLunBadType:            "Invalid LUN type",
+		ErrorCodeLunNotFound:           "No such LUN",
+		ErrorCodeSnapshotNotFound:      "No such snapshot",
+		ErrorCodeLunDuplicatedName:     "Duplicated LUN name",
+		ErrorCodeLunReachMaxCount:      "Number of LUNs reached the limit",
+		ErrorCodeSnapshotReachMaxCount: "Number of snapshots reached the limit",
+	},
+	"SYNO.Core.ISCSI.Target": {
+		ErrorCodeTargetReachMaxCount:  "Number of targets reached the limit",
+		ErrorCodeTargetDuplicatedName: "Duplicated target name",
+		ErrorCodeTargetNotFound:       "No such target",
+		ErrorCodeLunNotFound:          "No such LUN",
+	},
+}
+
+// APIError is an error returned by DSM web API
+type APIError struct {
+	API    string
+	Method string
+	Code   int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Failed to %s %s: %s(%d)", e.API, e.Method, e.Description(), e.Code)
+}
+
+// Description returns the description of the error code
+func (e *APIError) Description() string {
+	if desc, ok := errorCodeDescs[e.API][e.Code]; ok {
+		return desc
+	}
+	if desc := errorToDesc(e.Code); desc != "" {
+		return desc
+	}
+	return "Unknown error"
+}
+
+// IsSessionError returns true if the session used for the request was not valid
+func (e *APIError) IsSessionError() bool {
+	switch e.Code {
+	case ErrorCodeNoPermission, ErrorCodeSessionTimeout, ErrorCodeSessionInterrupted:
+		return true
+	}
+	return false
+}
+
+// IsAPIError returns true if err is an APIError with the code
+func IsAPIError(err error, code int) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Code == code
+}
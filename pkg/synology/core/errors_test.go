@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019 Ji-Young Park(jiyoung.park.dev@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************
+ * Tests
+ ************************************************************/
+
+func TestAPIError(t *testing.T) {
+	testCases := []struct {
+		err      *APIError
+		expected string
+	}{
+		{
+			&APIError{API: "SYNO.Core.ISCSI.LUN", Method: "create", Code: ErrorCodeLunNoSpace},
+			"Failed to SYNO.Core.ISCSI.LUN create: Out of free space(18990002)",
+		},
+		// codes common to all APIs
+		{
+			&APIError{API: "SYNO.Core.ISCSI.Target", Method: "list", Code: ErrorCodeSessionTimeout},
+			"Failed to SYNO.Core.ISCSI.Target list: Session timeout(106)",
+		},
+		// codes of other APIs are not used
+		{
+			&APIError{API: "SYNO.Core.Storage.Volume", Method: "get", Code: ErrorCodeLunNoSpace},
+			"Failed to SYNO.Core.Storage.Volume get: Unknown error(18990002)",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.EqualError(t, tc.err, tc.expected)
+	}
+}
+
+func TestAPIEntryError(t *testing.T) {
+	var logins int32
+	testServer := newTestServer(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(fmt.Sprintf(`{ "error": { "code": %d }, "success": false }`, ErrorCodeLunNotFound)))
+	})
+	defer testServer.Close()
+
+	s := NewSession(fmt.Sprintf("%s/webapi", testServer.URL), "Core", nil)
+	_, err := s.Login(testLoginOptions())
+	assert.NoError(t, err)
+
+	api := NewAPIEntry(s, "entry.cgi", "SYNO.Core.ISCSI.LUN", "1")
+	_, err = api.Get("get", url.Values{})
+
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, &APIError{API: "SYNO.Core.ISCSI.LUN", Method: "get", Code: ErrorCodeLunNotFound}, apiErr)
+	assert.True(t, IsAPIError(err, ErrorCodeLunNotFound))
+}
@@ -22,11 +22,15 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 
 	retry "github.com/avast/retry-go"
@@ -82,6 +86,9 @@ func loginErrorToDesc(code int) string {
 type Session interface {
 	GetSid() string
 	Login(synoOption *options.SynologyOptions) (string, error)
+	// Relogin logs in again if the session ID is still the current one,
+	// which DSM rejected as expired or interrupted
+	Relogin(staleSid string) (string, error)
 	Logout() error
 	Get(path string, params url.Values) (*http.Response, error)
 	Post(path string, data url.Values) (*http.Response, error)
@@ -131,45 +138,150 @@ func (r *responseData) String() string {
 	}
 }
 
+const (
+	// FormatSid passes the session ID by the "_sid" argument of requests
+	FormatSid = "sid"
+	// FormatCookie passes the session ID by the cookie DSM sets on login
+	FormatCookie = "cookie"
+
+	synoTokenHeader = "X-SYNO-TOKEN"
+)
+
+// credentials are what DSM returns on login to authenticate later requests
+type credentials struct {
+	sid string
+	// CSRF token, empty if DSM does not return one
+	synoToken string
+	// true if the session ID is passed by the cookie
+	cookie bool
+}
+
+// loginCall is a login in progress, which is shared by requests
+// that find the session expired at the same time
+type loginCall struct {
+	done chan struct{}
+	sid  string
+	err  error
+}
+
+// session is shared by the requests the driver handles concurrently
 type session struct {
-	sid         string
+	// current *credentials, swapped atomically on re-login
+	creds       atomic.Value
 	baseURL     string
 	sessionName string
+	client      *http.Client
 
+	// mu guards the fields below
+	mu            sync.Mutex
 	options       *options.SynologyOptions
 	timeoutMinute int
 	lastLoginTime *time.Time
+	// login in progress, nil if there is none
+	inflight *loginCall
 }
 
-// NewSession creates a new Session object
-func NewSession(baseURL string, sessionName string) Session {
-	return &session{
+// NewSession creates a new Session object, which sends requests with the client.
+// http.DefaultClient is used if client is nil
+func NewSession(baseURL string, sessionName string, client *http.Client) Session {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	s := &session{
 		baseURL:     baseURL,
 		sessionName: sessionName,
+		client:      client,
 	}
+	s.creds.Store(&credentials{})
+
+	return s
+}
+
+func (s *session) credentials() *credentials {
+	return s.creds.Load().(*credentials)
 }
 
 func (s *session) GetSid() string {
-	return s.sid
+	return s.credentials().sid
 }
 
-func (s *session) prepareArguments() (url.Values, error) {
-	return query.Values(s.options)
+func (s *session) prepareArguments(synoOptions *options.SynologyOptions) (url.Values, error) {
+	return query.Values(synoOptions)
 
 }
 
-func (s *session) login() (string, error) {
-	v, err := s.prepareArguments()
+// login logs in to DSM, or waits for the login in progress and returns its result,
+// so that only one login is made at a time.
+// If needed is given, it is called with mu held, and the current session ID is returned
+// without logging in if it returns false, e.g. when another request has just logged in.
+func (s *session) login(needed func() bool) (string, error) {
+	s.mu.Lock()
+	if call := s.inflight; call != nil {
+		s.mu.Unlock()
+
+		<-call.done
+		return call.sid, call.err
+	}
+	if needed != nil && !needed() {
+		s.mu.Unlock()
+		return s.GetSid(), nil
+	}
+
+	call := &loginCall{done: make(chan struct{})}
+	s.inflight = call
+	synoOptions := s.options
+	s.mu.Unlock()
+
+	result, err := s.doLogin(synoOptions)
+
+	s.mu.Lock()
+	if err == nil {
+		s.creds.Store(&result.credentials)
+		s.timeoutMinute = result.timeoutMinute
+		now := time.Now()
+		s.lastLoginTime = &now
+
+		// later logins pass the device ID to skip OTP checking
+		if result.deviceID != "" && s.options == synoOptions {
+			newOptions := *synoOptions
+			newOptions.DeviceId = &result.deviceID
+			s.options = &newOptions
+		}
+	}
+	s.inflight = nil
+	s.mu.Unlock()
+
+	call.sid, call.err = result.sid, err
+	close(call.done)
+
+	return result.sid, err
+}
+
+// loginResult is the result of a login
+type loginResult struct {
+	credentials
+	// device ID, returned if a device token is requested
+	deviceID      string
+	timeoutMinute int
+}
+
+// doLogin sends login requests, and returns the credentials and the timeout of the session
+func (s *session) doLogin(synoOptions *options.SynologyOptions) (loginResult, error) {
+	result := loginResult{}
+	result.cookie = synoOptions.Format == FormatCookie
+
+	v, err := s.prepareArguments(synoOptions)
 	if err != nil {
 		glog.Errorf("Failed parsing URL parameters: %v", err)
-		return "", err
+		return result, err
 	}
 
 	var uri string
 	var requestBody []byte
 	var method string
 
-	if s.options.LoginApiVersion >= 6 {
+	if synoOptions.LoginApiVersion >= 6 {
 		uri = fmt.Sprintf(
 			"%s/%s",
 			s.baseURL,
@@ -191,10 +303,6 @@ func (s *session) login() (string, error) {
 	authResp := responseData{}
 	var body []byte
 
-	client := &http.Client{
-		CheckRedirect: nil,
-	}
-
 	err = retry.Do(
 		func() error {
 			glog.Infof("Logging in via %s", uri)
@@ -215,7 +323,7 @@ func (s *session) login() (string, error) {
 				req.Header.Add("Content-Length", strconv.Itoa(len(requestBody)))
 			}
 
-			resp, err := client.Do(req)
+			resp, err := s.client.Do(req)
 			if err != nil {
 				glog.Errorf("Failed logging in: %v", err)
 				return err
@@ -258,17 +366,27 @@ func (s *session) login() (string, error) {
 	)
 
 	if err != nil {
-		return "", err
+		return result, err
 	}
 
-	if err = json.Unmarshal(*authResp.Data["sid"], &s.sid); err != nil {
+	if err = json.Unmarshal(*authResp.Data["sid"], &result.sid); err != nil {
 		glog.Errorf("Failed to parse auth authResp.Data.sid: %s(%v)", authResp.String(), err)
-		return "", err
+		return result, err
+	}
+	// synotoken is returned if enable_syno_token is set, and did if enable_device_token is set
+	for name, value := range map[string]*string{"synotoken": &result.synoToken, "did": &result.deviceID} {
+		if authResp.Data[name] == nil {
+			continue
+		}
+		if err = json.Unmarshal(*authResp.Data[name], value); err != nil {
+			glog.Errorf("Failed to parse auth authResp.Data.%s: %s(%v)", name, authResp.String(), err)
+			return result, err
+		}
 	}
 
 	// get login timeout
 	securityParams := url.Values{
-		"_sid":    {s.sid},
+		"_sid":    {result.sid},
 		"api":     {"SYNO.Core.Security.DSM"},
 		"version": {"1"},
 		"method":  {"get"},
@@ -277,9 +395,13 @@ func (s *session) login() (string, error) {
 	urlObj, _ := url.Parse(fmt.Sprintf("%s/entry.cgi", s.baseURL))
 	urlObj.RawQuery = securityParams.Encode()
 
-	secResp, err := http.Get(urlObj.String())
+	req, _ := http.NewRequest("GET", urlObj.String(), nil)
+	if result.synoToken != "" {
+		req.Header.Set(synoTokenHeader, result.synoToken)
+	}
+	secResp, err := s.client.Do(req)
 	if err != nil {
-		return "", errors.New("Failed to get security config")
+		return result, errors.New("Failed to get security config")
 	}
 
 	body, err = ioutil.ReadAll(secResp.Body)
@@ -292,82 +414,146 @@ func (s *session) login() (string, error) {
 	securityRespData := securityResponseData{}
 	if err = json.Unmarshal(body, &securityRespData); err != nil {
 		glog.Errorf("Failed to parse auth response: %s(%v)", body, err)
-		return "", err
+		return result, err
 	}
 
 	if !securityRespData.Success {
 		glog.Errorf("Failed to query security config, set timeout to 0: (code: %d)", securityRespData.Error.Code)
-		s.timeoutMinute = 0
 	} else {
-		s.timeoutMinute = securityRespData.Data.Timeout
+		result.timeoutMinute = securityRespData.Data.Timeout
 	}
 
-	now := time.Now()
-	s.lastLoginTime = &now
+	glog.Infof("Logged in. Timeout minute: %d", result.timeoutMinute)
 
-	glog.Infof("Logged in. Timeout minute: %d", s.timeoutMinute)
+	return result, nil
+}
 
-	return s.sid, nil
+// expired returns true if the session is about to time out, mu must be held
+func (s *session) expired() bool {
+	minuteSinceLastLogin := time.Since(*s.lastLoginTime)
+	return int(minuteSinceLastLogin.Minutes()) >= s.timeoutMinute-1
 }
 
 func (s *session) ensureLoggedIn() error {
-	if s.lastLoginTime == nil {
-		return errors.New("Session has not been logged in yet")
-	}
+	s.mu.Lock()
+	loggedIn := s.lastLoginTime != nil
+	loginTried := s.options != nil
+	s.mu.Unlock()
+
+	if !loggedIn {
+		if !loginTried {
+			return errors.New("Session has not been logged in yet")
+		}
 
-	minuteSinceLastLogin := time.Since(*s.lastLoginTime)
-	if int(minuteSinceLastLogin.Minutes()) < s.timeoutMinute-1 {
-		return nil
+		// the login has failed, e.g. DSM was unreachable, and is retried by requests
+		_, err := s.login(func() bool {
+			return s.lastLoginTime == nil
+		})
+		return err
 	}
 
-	// re-login
-	_, err := s.login()
+	// re-login if expired, requests finding the session expired share a login
+	_, err := s.login(s.expired)
 	return err
 }
 
 func (s *session) Login(options *options.SynologyOptions) (string, error) {
+	s.mu.Lock()
 	s.options = options
+	if options.Format == FormatCookie && s.client.Jar == nil {
+		// keep the session cookie DSM sets on login
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			s.mu.Unlock()
+			return "", err
+		}
+		client := *s.client
+		client.Jar = jar
+		s.client = &client
+	}
+	s.mu.Unlock()
+
+	return s.login(nil)
+}
 
-	return s.login()
+func (s *session) Relogin(staleSid string) (string, error) {
+	// requests rejected with the same session ID share a login
+	return s.login(func() bool {
+		return s.GetSid() == staleSid
+	})
 }
 
 func (s *session) Logout() error {
 
 	params := url.Values{
-		"_sid":    {s.sid},
+		"_sid":    {s.GetSid()},
 		"session": {s.sessionName},
 	}
 
 	urlObj, _ := url.Parse(fmt.Sprintf("%s/auth.cgi", s.baseURL))
 	urlObj.RawQuery = params.Encode()
 
-	_, err := http.Get(urlObj.String())
+	resp, err := s.client.Get(urlObj.String())
+	if err != nil {
+		return err
+	}
 
-	return err
+	return resp.Body.Close()
 }
 
+// Get sends a GET request with the credentials of the current login
 func (s *session) Get(path string, params url.Values) (*http.Response, error) {
 	if err := s.ensureLoggedIn(); err != nil {
 		return nil, err
 	}
+	creds := s.credentials()
+	if !creds.cookie {
+		params.Set("_sid", creds.sid)
+	}
 
 	urlObj, _ := url.Parse(fmt.Sprintf("%s/%s", s.baseURL, path))
 	urlObj.RawQuery = params.Encode()
 
 	glog.V(8).Infof("Querying %s\n", urlObj.String())
 
-	return http.Get(urlObj.String())
+	req, err := http.NewRequest("GET", urlObj.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.do(req, creds)
 }
 
+// Post sends a POST request with the credentials of the current login
 func (s *session) Post(path string, data url.Values) (*http.Response, error) {
 	if err := s.ensureLoggedIn(); err != nil {
 		return nil, err
 	}
+	creds := s.credentials()
+	if !creds.cookie {
+		data.Set("_sid", creds.sid)
+	}
 
 	targetURL := fmt.Sprintf("%s/%s", s.baseURL, path)
 
 	glog.V(8).Infof("Postting %s: %#v\n", targetURL, data)
-	return http.PostForm(targetURL, data)
+
+	req, err := http.NewRequest("POST", targetURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return s.do(req, creds)
+}
+
+// do sends the request with the CSRF token, which DSM requires if CSRF protection is enabled
+func (s *session) do(req *http.Request, creds *credentials) (*http.Response, error) {
+	if creds.synoToken != "" {
+		req.Header.Set(synoTokenHeader, creds.synoToken)
+	}
+
+	return s.client.Do(req)
 }
 
 /************************************************************
@@ -397,55 +583,74 @@ func NewAPIEntry(s Session, path string, api string, version string) APIEntry {
 	}
 }
 
+// idempotentMethods are methods which do not change anything on DSM.
+// Read-only methods used by the API wrappers must be listed here to be retried.
+var idempotentMethods = map[string]bool{
+	"list":          true,
+	"get":           true,
+	"list_snapshot": true,
+	"get_snapshot":  true,
+}
+
 // Get sends 'GET' request to the endpoint for the method with the parameters
 // It returns value of 'data' field when the request succeeds
 func (e *apiEntry) Get(method string, params url.Values) (map[string]*json.RawMessage, error) {
+	return e.request(e.session.Get, method, params)
+}
+
+// Post sends 'POST' request to the endpoint for the method with the parameters
+// It returns value of 'data' field when the request succeeds, or nil if
+// the request fails or response does not contain data
+func (e *apiEntry) Post(method string, params url.Values) (map[string]*json.RawMessage, error) {
+	return e.request(e.session.Post, method, params)
+}
+
+// request sends the request, and retries it once after logging in again
+// if DSM rejects the session, which can expire earlier than the timeout we know of.
+func (e *apiEntry) request(
+	send func(path string, params url.Values) (*http.Response, error),
+	method string,
+	params url.Values,
+) (map[string]*json.RawMessage, error) {
 	params.Add("api", e.api)
 	params.Add("version", e.version)
 	params.Add("method", method)
-	params.Add("_sid", e.session.GetSid())
 
-	resp, err := e.session.Get(e.path, params)
-	if err != nil {
-		return nil, err
+	sid := e.session.GetSid()
+	data, err := e.send(send, method, params)
+	apiErr, ok := err.(*APIError)
+	if !ok || !apiErr.IsSessionError() {
+		return data, err
 	}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			glog.Errorf("Failed closing the body: %v", err)
-		}
-	}()
-
-	body, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, readErr
+	// DSM rejects requests with expired or interrupted sessions before handling them,
+	// but 'no permission' may be returned after a method fails partway,
+	// so that only methods without side effects are retried for it
+	if apiErr.Code == ErrorCodeNoPermission && !idempotentMethods[method] {
+		return data, err
 	}
 
-	var data responseData
-	if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
-		glog.V(3).Infof("Failed to parse response: %s", body)
-		return nil, jsonErr
+	// the session sets _sid of the request, unless the session ID is passed by the cookie
+	staleSid := params.Get("_sid")
+	if staleSid == "" {
+		staleSid = sid
 	}
+	glog.V(3).Infof("Session %s was rejected for %s.%s: %v, logging in again", staleSid, e.api, method, err)
 
-	if !data.Success {
-		code := data.Error.Code
-		msg := fmt.Sprintf("Failed to %s: %s(%d)", method, errorToDesc(code), code)
-		return nil, errors.New(msg)
+	if _, loginErr := e.session.Relogin(staleSid); loginErr != nil {
+		glog.Errorf("Failed to login again: %v", loginErr)
+		return nil, err
 	}
 
-	return data.Data, nil
+	return e.send(send, method, params)
 }
 
-// Post sends 'POST' request to the endpoint for the method with the parameters
-// It returns value of 'data' field when the request succeeds, or nil if
-// the request fails or response does not contain data
-func (e *apiEntry) Post(method string, params url.Values) (map[string]*json.RawMessage, error) {
-	params.Add("api", e.api)
-	params.Add("version", e.version)
-	params.Add("method", method)
-	params.Add("_sid", e.session.GetSid())
-
-	resp, err := e.session.Post(e.path, params)
+func (e *apiEntry) send(
+	send func(path string, params url.Values) (*http.Response, error),
+	method string,
+	params url.Values,
+) (map[string]*json.RawMessage, error) {
+	resp, err := send(e.path, params)
 	if err != nil {
 		return nil, err
 	}
@@ -463,14 +668,12 @@ func (e *apiEntry) Post(method string, params url.Values) (map[string]*json.RawM
 
 	var data responseData
 	if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
-		glog.V(3).Infof("Failed to parse: %s", body)
+		glog.V(3).Infof("Failed to parse response: %s", body)
 		return nil, jsonErr
 	}
 
 	if !data.Success {
-		code := data.Error.Code
-		msg := fmt.Sprintf("Failed to %s: %s(%d)", method, errorToDesc(code), code)
-		return nil, errors.New(msg)
+		return nil, &APIError{API: e.api, Method: method, Code: data.Error.Code}
 	}
 
 	return data.Data, nil
@@ -18,15 +18,65 @@ package core
 
 import (
 	"fmt"
-	"github.com/jparklab/synology-csi/pkg/synology/options"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/jparklab/synology-csi/pkg/synology/options"
 )
 
+// newTestServer creates a DSM server which issues session IDs sid-1, sid-2, ... on each login,
+// and handles other requests with the handler
+func newTestServer(t *testing.T, timeout int, logins *int32, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(newTestHandler(t, timeout, logins, handler))
+}
+
+func newTestHandler(t *testing.T, timeout int, logins *int32, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		params := req.Form
+
+		switch {
+		case req.URL.Path == "/webapi/auth.cgi" && params.Get("method") == "login":
+			assert.Equal(t, "SYNO.API.Auth", params.Get("api"))
+			n := atomic.AddInt32(logins, 1)
+			resp.Write([]byte(fmt.Sprintf(`{
+				"data": { "sid": "sid-%d" },
+				"success": true
+			}`, n)))
+		case req.URL.Path == "/webapi/entry.cgi" && params.Get("api") == "SYNO.Core.Security.DSM":
+			resp.Write([]byte(fmt.Sprintf(`{
+				"data": { "timeout": %d },
+				"success": true
+			}`, timeout)))
+		default:
+			handler(resp, req)
+		}
+	}
+}
+
+func testLoginOptions() *options.SynologyOptions {
+	synoOptions := options.NewSynologyOptions()
+	synoOptions.Username = "username"
+	synoOptions.Password = "password"
+	return &synoOptions
+}
+
+// expire makes the session time out
+func expire(s Session) {
+	sess := s.(*session)
+	sess.mu.Lock()
+	past := time.Now().Add(-time.Hour)
+	sess.lastLoginTime = &past
+	sess.mu.Unlock()
+}
+
 /************************************************************
  * Tests
  ************************************************************/
@@ -38,97 +88,93 @@ func TestSessionNotLoggedIn(t *testing.T) {
 	defer testServer.Close()
 
 	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
-	session := NewSession(baseURL, "Core")
+	session := NewSession(baseURL, "Core", nil)
 
 	_, err := session.Get("dummy", url.Values{})
 	assert.EqualError(t, err, "Session has not been logged in yet")
 }
 
 func TestSessionLogin(t *testing.T) {
+	var logins int32
+	testServer := newTestServer(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+		t.Errorf("Unexpected request: %s", req.URL)
+	})
+	defer testServer.Close()
 
-	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		params := req.URL.Query()
+	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
+	s := NewSession(baseURL, "Core", nil)
 
-		switch req.URL.Path {
-		case "/webapi/auth.cgi":
-			{
-				method := params.Get("method")
-				if method == "login" {
-					resp.Write([]byte(`{
-						"data": { "sid": "test_sid" },
-						"success": true
-					}`))
-				} else {
-					assert.Equal(t, "SYNO.Core.Security.DSM", params.Get("api"))
-					resp.Write([]byte(`{
-						"timeout": 10
-					}`))
-				}
-			}
+	// test login
+	sid, err := s.Login(testLoginOptions())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sid-1", sid)
+	assert.Equal(t, "sid-1", s.GetSid())
+	assert.Equal(t, 10, s.(*session).timeoutMinute)
+}
+
+// Tests if requests log in to DSM which has rejected the login
+func TestSessionFailedLogin(t *testing.T) {
+	var logins, blocked int32 = 0, 1
+	handler := newTestHandler(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{ "data": { "value": "value_1" }, "success": true }`))
+	})
+	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// failed logins are retried with delays unless DSM rejects them, e.g. for blocked IPs
+		if atomic.LoadInt32(&blocked) == 1 {
+			resp.Write([]byte(`{ "error": { "code": 407 }, "success": false }`))
+			return
 		}
+		handler(resp, req)
 	}))
-
 	defer testServer.Close()
 
 	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
-	s := NewSession(baseURL, "Core")
+	s := NewSession(baseURL, "Core", nil)
+	api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
 
-	// test login
-	sid, err := s.Login(&options.SynologyOptions{
-		Username: "username",
-		Password: "password",
-	})
+	_, err := s.Login(testLoginOptions())
+	assert.Error(t, err)
 
+	_, err = api.Get("list", url.Values{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&logins))
+
+	atomic.StoreInt32(&blocked, 0)
+	data, err := api.Get("list", url.Values{})
 	assert.NoError(t, err)
-	assert.Equal(t, "test_sid", sid)
-	assert.Equal(t, 10, s.(*session).timeoutMinute)
+	assert.Equal(t, `"value_1"`, string(*data["value"]))
+	assert.Equal(t, "sid-1", s.GetSid())
+
+	// the session is not logged in again
+	_, err = api.Get("list", url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
 }
 
 func TestAPIEntry(t *testing.T) {
-	sid := "test_sid_entry"
-
-	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+	var logins int32
+	testServer := newTestServer(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
 		params := req.URL.Query()
-		switch req.URL.Path {
-		case "/webapi/auth.cgi":
-			{
-				method := params.Get("method")
-				if method == "login" {
-					resp.Write([]byte(fmt.Sprintf(`{
-						"data": { "sid": "%s" },
-						"success": true
-					}`, sid)))
-				} else {
-					assert.Equal(t, "SYNO.Core.Security.DSM", params.Get("api"))
-					resp.Write([]byte(`{
-						"timeout": 1
-					}`))
-				}
-			}
-		case "/webapi/entry.cgi":
-			{
-				assert.Equal(t, "TestAPI", params.Get("api"))
-				assert.Equal(t, sid, params.Get("_sid"))
 
-				assert.Equal(t, "sample", params.Get("name"))
+		assert.Equal(t, "/webapi/entry.cgi", req.URL.Path)
+		assert.Equal(t, "TestAPI", params.Get("api"))
+		assert.Equal(t, "sid-1", params.Get("_sid"))
 
-				resp.Write([]byte(`{ 
-					"data": { "value": "value_1" },
-					"success": true
-				}`))
-			}
-		}
-	}))
+		assert.Equal(t, "sample", params.Get("name"))
 
+		resp.Write([]byte(`{ 
+			"data": { "value": "value_1" },
+			"success": true
+		}`))
+	})
 	defer testServer.Close()
 
 	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
-	s := NewSession(baseURL, "Core")
+	s := NewSession(baseURL, "Core", nil)
 
-	s.Login(&options.SynologyOptions{
-		Username: "username",
-		Password: "password",
-	})
+	_, err := s.Login(testLoginOptions())
+	assert.NoError(t, err)
 
 	api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
 
@@ -139,3 +185,224 @@ func TestAPIEntry(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, `"value_1"`, string(*resp["value"]))
 }
+
+// Tests if concurrent requests finding the session expired share a login
+func TestSessionConcurrentRelogin(t *testing.T) {
+	var logins int32
+	testServer := newTestServer(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		// requests are sent with the session ID of the new login
+		assert.Equal(t, "sid-2", req.Form.Get("_sid"))
+
+		resp.Write([]byte(`{ "data": {}, "success": true }`))
+	})
+	defer testServer.Close()
+
+	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
+	s := NewSession(baseURL, "Core", nil)
+
+	_, err := s.Login(testLoginOptions())
+	assert.NoError(t, err)
+	expire(s)
+
+	api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var err error
+			if i%2 == 0 {
+				_, err = api.Get("get", url.Values{})
+			} else {
+				_, err = api.Post("set", url.Values{})
+			}
+			assert.NoError(t, err)
+			// read the session ID while it may be swapped
+			s.GetSid()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+	assert.Equal(t, "sid-2", s.GetSid())
+}
+
+// Tests if requests rejected by DSM for the session are retried after logging in again
+func TestAPIEntryRelogin(t *testing.T) {
+	testCases := []struct {
+		method  string
+		code    int
+		retried bool
+	}{
+		{"create", ErrorCodeSessionTimeout, true},
+		{"create", ErrorCodeSessionInterrupted, true},
+		{"list", ErrorCodeNoPermission, true},
+		{"get_snapshot", ErrorCodeNoPermission, true},
+		{"list_snapshot", ErrorCodeNoPermission, true},
+		// methods with side effects may have failed partway
+		{"create", ErrorCodeNoPermission, false},
+		{"take_snapshot", ErrorCodeNoPermission, false},
+		{"create", ErrorCodeInvalidParameter, false},
+	}
+
+	for _, tc := range testCases {
+		var logins, requests int32
+		testServer := newTestServer(t, 10, &logins, func(resp http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+
+			req.ParseForm()
+			if req.Form.Get("_sid") == "sid-1" {
+				resp.Write([]byte(fmt.Sprintf(`{ "error": { "code": %d }, "success": false }`, tc.code)))
+				return
+			}
+			resp.Write([]byte(`{ "data": { "value": "value_1" }, "success": true }`))
+		})
+
+		baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
+		s := NewSession(baseURL, "Core", nil)
+		_, err := s.Login(testLoginOptions())
+		assert.NoError(t, err)
+
+		api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
+
+		// requests rejected at the same time share a login
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				data, err := api.Post(tc.method, url.Values{})
+				if tc.retried {
+					assert.NoError(t, err, tc)
+					assert.Equal(t, `"value_1"`, string(*data["value"]), tc)
+				} else {
+					assert.True(t, IsAPIError(err, tc.code), tc)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if tc.retried {
+			assert.Equal(t, int32(2), atomic.LoadInt32(&logins), tc)
+			assert.Equal(t, int32(20), atomic.LoadInt32(&requests), tc)
+		} else {
+			assert.Equal(t, int32(1), atomic.LoadInt32(&logins), tc)
+			assert.Equal(t, int32(10), atomic.LoadInt32(&requests), tc)
+		}
+
+		testServer.Close()
+	}
+}
+
+// Tests if the CSRF token and the device ID returned on login are used by later requests
+func TestSessionSynoToken(t *testing.T) {
+	var logins, requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		params := req.Form
+
+		switch {
+		case req.URL.Path == "/webapi/auth.cgi":
+			n := atomic.AddInt32(&logins, 1)
+			if n == 1 {
+				assert.Empty(t, params.Get("device_id"))
+			} else {
+				// OTP is skipped with the device ID
+				assert.Equal(t, "device-1", params.Get("device_id"))
+			}
+			assert.Equal(t, "yes", params.Get("enable_syno_token"))
+			resp.Write([]byte(fmt.Sprintf(`{
+				"data": { "sid": "sid-%d", "synotoken": "token-%d", "did": "device-1" },
+				"success": true
+			}`, n, n)))
+		case params.Get("api") == "SYNO.Core.Security.DSM":
+			resp.Write([]byte(`{ "data": { "timeout": 10 }, "success": true }`))
+		default:
+			atomic.AddInt32(&requests, 1)
+			n := atomic.LoadInt32(&logins)
+			assert.Equal(t, fmt.Sprintf("sid-%d", n), params.Get("_sid"))
+			assert.Equal(t, fmt.Sprintf("token-%d", n), req.Header.Get("X-SYNO-TOKEN"))
+			resp.Write([]byte(`{ "data": { "value": "value_1" }, "success": true }`))
+		}
+	}))
+	defer testServer.Close()
+
+	yes := "yes"
+	synoOptions := testLoginOptions()
+	synoOptions.LoginApiVersion = 6
+	synoOptions.EnableSynoToken = &yes
+	synoOptions.EnableDeviceToken = &yes
+
+	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
+	s := NewSession(baseURL, "Core", nil)
+	_, err := s.Login(synoOptions)
+	assert.NoError(t, err)
+	// options of the caller are not changed
+	assert.Nil(t, synoOptions.DeviceId)
+
+	api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
+	_, err = api.Get("list", url.Values{})
+	assert.NoError(t, err)
+	_, err = api.Post("create", url.Values{})
+	assert.NoError(t, err)
+
+	expire(s)
+	_, err = api.Post("create", url.Values{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+// Tests if the session ID is passed by the cookie DSM sets with format=cookie
+func TestSessionCookie(t *testing.T) {
+	var logins, requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		params := req.Form
+
+		switch {
+		case req.URL.Path == "/webapi/auth.cgi":
+			assert.Equal(t, "cookie", params.Get("format"))
+			n := atomic.AddInt32(&logins, 1)
+			http.SetCookie(resp, &http.Cookie{Name: "id", Value: fmt.Sprintf("sid-%d", n), Path: "/"})
+			resp.Write([]byte(fmt.Sprintf(`{ "data": { "sid": "sid-%d" }, "success": true }`, n)))
+		case params.Get("api") == "SYNO.Core.Security.DSM":
+			resp.Write([]byte(`{ "data": { "timeout": 10 }, "success": true }`))
+		default:
+			atomic.AddInt32(&requests, 1)
+			assert.Empty(t, params.Get("_sid"))
+
+			cookie, err := req.Cookie("id")
+			if !assert.NoError(t, err) || cookie.Value == "sid-1" {
+				resp.Write([]byte(fmt.Sprintf(`{ "error": { "code": %d }, "success": false }`, ErrorCodeSessionTimeout)))
+				return
+			}
+			resp.Write([]byte(`{ "data": { "value": "value_1" }, "success": true }`))
+		}
+	}))
+	defer testServer.Close()
+
+	synoOptions := testLoginOptions()
+	synoOptions.Format = FormatCookie
+
+	baseURL := fmt.Sprintf("%s/webapi", testServer.URL)
+	s := NewSession(baseURL, "Core", nil)
+	_, err := s.Login(synoOptions)
+	assert.NoError(t, err)
+
+	// the request with the rejected cookie is retried after logging in again
+	api := NewAPIEntry(s, "entry.cgi", "TestAPI", "1")
+	data, err := api.Get("list", url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, `"value_1"`, string(*data["value"]))
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	// the default client is not changed
+	assert.Nil(t, http.DefaultClient.Jar)
+}
@@ -1,7 +1,13 @@
 package options
 
+import (
+	"time"
+)
+
 // SynologyOptions contains options to access Synology NAS web api
 type SynologyOptions struct {
+	// Name of the backend, required when multiple backends are configured
+	Name            string `yaml:"name"  url:"-"`
 	Host            string `yaml:"host"  url:"-"`
 	Port            int    `yaml:"port"  url:"-"`
 	SslVerify       bool   `yaml:"sslVerify" url:",omitempty"`
@@ -10,6 +16,28 @@ type SynologyOptions struct {
 	API             string `yaml:"-" url:"api"`
 	Method          string `yaml:"-" url:"method"`
 
+	// Topology segments of nodes which can access the NAS, empty if all nodes can access it
+	Topology map[string]string `yaml:"topology" url:"-"`
+	// ISCSI portals(<ip>[:<port>]) of the NAS, LUNs are accessed through multiple paths
+	// if more than one portal is given. Defaults to the host
+	Portals []string `yaml:"portals" url:"-"`
+
+	// PEM file of CA certificates to verify the certificate of the NAS, system CAs are used if empty
+	CAFile string `yaml:"caFile" url:"-"`
+	// Do not verify the certificate of the NAS. SslVerify only selects https,
+	// and the certificate is verified unless this is set
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify" url:"-"`
+	// PEM files of the client certificate and its key, if the NAS requires client certificates
+	CertFile string `yaml:"certFile" url:"-"`
+	KeyFile  string `yaml:"keyFile" url:"-"`
+	// Timeout of each request(e.g. 30s), 60s if not set
+	Timeout time.Duration `yaml:"timeout" url:"-"`
+	// URL of the proxy, proxies in HTTP_PROXY/HTTPS_PROXY environment variables are used if empty
+	Proxy string `yaml:"proxy" url:"-"`
+	// Maximum idle(keep-alive) connections to the NAS, and how long they are kept
+	MaxIdleConns    int           `yaml:"maxIdleConns" url:"-"`
+	IdleConnTimeout time.Duration `yaml:"idleConnTimeout" url:"-"`
+
 	// === Version 1 and later, DSM 3.2 ===
 	// Required.
 	// Login account name
@@ -30,7 +58,8 @@ type SynologyOptions struct {
 	// response json data only. User can append this session ID manually to get access to
 	// any other Web API without interrupting other logins.
 	// If not specified, default login format is “cookie.”
-	Format string `yaml:"-" url:"format"`
+	// The driver uses “sid” unless it is set to “cookie” in the config.
+	Format string `yaml:"format" url:"format"`
 
 	// === Version 3, DSM 4.2 ===
 	// Optional.